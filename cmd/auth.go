@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// repoAuth authenticates requests to repo. kure.json only references
+// secrets, they are read from environment or netrc file when needed.
+//
+//	{"type": "bearer", "token_env": "GITEA_TOKEN"}
+//	{"type": "basic", "username_env": "STORE_USER", "password_env": "STORE_PASSWORD"}
+//	{"type": "netrc", "netrc": "~/.netrc"}
+//
+// Bearer and basic credentials are sent only to host of repo url. Netrc
+// credentials are picked by host, so they work for mirrors too.
+type repoAuth struct {
+	*authConfig
+	host string
+}
+
+// newRepoAuth returns auth of repo with given url. It's nil for public repos.
+func newRepoAuth(c *authConfig, repoURL string) *repoAuth {
+	if c == nil {
+		return nil
+	}
+	a := &repoAuth{authConfig: c}
+	u, err := url.Parse(repoURL)
+	if err == nil {
+		a.host = u.Hostname()
+	}
+	return a
+}
+
+// header returns value of Authorization header for url. It's empty when
+// there are no credentials for url host. Nil auth never has credentials.
+func (a *repoAuth) header(rawurl string) (string, error) {
+	if a == nil || isLocalURL(rawurl) {
+		return "", nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	host := u.Hostname()
+	switch a.Type {
+	case "bearer":
+		if host != a.host {
+			return "", nil
+		}
+		token, err := secretEnv(a.TokenEnv)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	case "basic":
+		if host != a.host {
+			return "", nil
+		}
+		user, err := secretEnv(a.UsernameEnv)
+		if err != nil {
+			return "", err
+		}
+		password, err := secretEnv(a.PasswordEnv)
+		if err != nil {
+			return "", err
+		}
+		return basicAuth(user, password), nil
+	case "netrc":
+		login, password, found, err := netrcLookup(a.Netrc, host)
+		if err != nil || !found {
+			return "", err
+		}
+		return basicAuth(login, password), nil
+	}
+	return "", nil
+}
+
+func secretEnv(name string) (string, error) {
+	value, found := os.LookupEnv(name)
+	if !found || value == "" {
+		return "", fmt.Errorf("Environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// netrcLookup finds credentials for host in netrc file. Empty path means
+// $NETRC or ~/.netrc.
+func netrcLookup(path, host string) (login, password string, found bool, err error) {
+	if path == "" {
+		path = os.Getenv("NETRC")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false, err
+		}
+		path = filepath.Join(home, ".netrc")
+	} else if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false, err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", false, fmt.Errorf("Could not read netrc file: %s", err)
+	}
+
+	fields := strings.Fields(string(data))
+	var machine string
+	var defLogin, defPassword string
+	var hasDefault bool
+	for i := 0; i < len(fields); i++ {
+		next := ""
+		if i+1 < len(fields) {
+			next = fields[i+1]
+		}
+		switch fields[i] {
+		case "machine":
+			machine = next
+			i++
+		case "default":
+			machine = ""
+			hasDefault = true
+		case "login":
+			if machine == host {
+				login, found = next, true
+			} else if machine == "" && hasDefault {
+				defLogin = next
+			}
+			i++
+		case "password":
+			if machine == host {
+				password, found = next, true
+			} else if machine == "" && hasDefault {
+				defPassword = next
+			}
+			i++
+		case "account":
+			i++
+		case "macdef":
+			// macro body ends with empty line, fields do not keep it, so
+			// rest of file is skipped
+			i = len(fields)
+		}
+	}
+	if !found && hasDefault {
+		return defLogin, defPassword, true, nil
+	}
+	return login, password, found, nil
+}
+
+// redactURL hides password in url, so it can be printed
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	return u.Redacted()
+}
@@ -5,6 +5,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -12,6 +15,8 @@ import (
 var (
 	verboseNetkan    = false
 	prereleaseNetkan = false
+	buildNetkan      string
+	buildJobs        int
 )
 
 // buildCmd represents the build command
@@ -25,17 +30,32 @@ var buildCmd = &cobra.Command{
 		if c := checkWorkspace(); c != nil {
 			return c
 		}
-		var err error
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
+		b, err := newNetkanBuild(buildNetkan)
+		if err != nil {
+			return err
+		}
+		if verbose {
+			fmt.Printf("Using netkan %s\n", b.version)
+		}
 		if len(args) > 0 {
 			for _, p := range args {
-				p, err := filepath.Abs(p)
+				p, err = filepath.Abs(p)
+				if err != nil {
+					break
+				}
+				err = b.run(p)
 				if err != nil {
-					return err
+					break
 				}
-				err = updateNetkanFile(p)
 			}
 		} else {
-			err = updateAll()
+			err = updateAll(b)
+		}
+		if serr := b.state.save(); serr != nil && err == nil {
+			err = serr
 		}
 		return err
 	},
@@ -45,32 +65,111 @@ func init() {
 	RootCmd.AddCommand(buildCmd)
 	buildCmd.Flags().BoolVarP(&verboseNetkan, "verbose-netkan", "V", false, "Print verbose output of netkan.exe tool")
 	buildCmd.Flags().BoolVarP(&prereleaseNetkan, "prerelease", "p", false, "netkan.exe tool will index github prereleases")
+	buildCmd.Flags().StringVar(&buildNetkan, "netkan", "", "Use given netkan.exe version instead of active one")
+	buildCmd.Flags().IntVarP(&buildJobs, "jobs", "j", 0, "Number of netkans built at once, build_jobs from config by default")
+}
+
+// netkanBuild runs netkan.exe and records results in workspace state
+type netkanBuild struct {
+	version string
+	exe     string
+	sha256  string
+	// guards state, builds may run in parallel
+	mu    sync.Mutex
+	state *workspaceState
 }
 
-func updateAll() error {
-	pwd, err := os.Getwd()
+func newNetkanBuild(override string) (*netkanBuild, error) {
+	version, exe, err := activeNetkan(override)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sum, err := hashFile(exe)
+	if err != nil {
+		return nil, err
 	}
-	err = filepath.Walk(filepath.Join(pwd, "local", "netkan"),
+	state, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	return &netkanBuild{version: version, exe: exe, sha256: sum, state: state}, nil
+}
+
+// run builds single netkan file
+func (b *netkanBuild) run(path string) error {
+	err := updateNetkanFile(path, b.exe)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state.setBuild(workspaceRel(path), buildResult{
+		Netkan:       b.version,
+		NetkanSHA256: b.sha256,
+		Built:        time.Now(),
+		Failed:       err != nil,
+	})
+	return err
+}
+
+func updateAll(b *netkanBuild) error {
+	var paths []string
+	err := filepath.Walk(workspacePath("local", "netkan"),
 		func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 			if !f.IsDir() {
-				Done("Building %s\n", filepath.Base(path))
-				return updateNetkanFile(path)
+				paths = append(paths, path)
 			}
 			return nil
 		})
-
-	return err
-}
-
-func updateNetkanFile(path string) error {
-	pwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
+
+	jobs := buildJobs
+	if jobs <= 0 {
+		jobs = conf.BuildJobs
+	}
+	if jobs <= 0 {
+		jobs = 1
+	}
+	queue := make(chan string)
+	errs := make(chan error, len(paths))
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range queue {
+				Done("Building %s\n", filepath.Base(path))
+				err := b.run(path)
+				if err != nil {
+					Warn("Building %s failed: %s\n", filepath.Base(path), err)
+				}
+				errs <- err
+			}
+		}()
+	}
+	for _, path := range paths {
+		queue <- path
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d netkans failed to build", failed, len(paths))
+	}
+	return nil
+}
+
+func updateNetkanFile(path, netkan string) error {
 	outputDir := filepath.Join("local", "ckan")
-	netkanFile, err := filepath.Rel(pwd, path)
+	netkanFile, err := filepath.Rel(workspaceDir, path)
 	if err != nil {
 		return err
 	}
@@ -84,24 +183,41 @@ func updateNetkanFile(path string) error {
 		netkanPrereleaseFlag = "--prerelease"
 	}
 
-	mono, err := exec.LookPath("mono")
+	cacheDir, err := downloadDir()
 	if err != nil {
 		return err
 	}
-	netkan, err := filepath.Abs(filepath.Join("cache", "bin", "netkan.exe"))
+	err = os.MkdirAll(cacheDir, DirPerm)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(
-		mono,
+	runner, err := exec.LookPath(conf.NetkanRunner)
+	if err != nil {
+		return err
+	}
+	args := []string{
 		netkan,
-		"--outputdir="+outputDir,
+		"--outputdir=" + outputDir,
+		"--cachedir=" + cacheDir,
 		netkanPrereleaseFlag,
 		netkanVerboseFlag,
-		netkanFile,
-	)
-	fmt.Printf("%+v\n", cmd)
+	}
+	printed := append([]string{runner}, args...)
+	if conf.GitHubTokenEnv != "" {
+		token, err := secretEnv(conf.GitHubTokenEnv)
+		if err != nil {
+			return err
+		}
+		// netkan.exe takes token only as argument, see github_token_env
+		args = append(args, "--github-token="+token)
+		printed = append(printed, "--github-token=***")
+	}
+	args = append(args, netkanFile)
+	cmd := exec.Command(runner, args...)
+	// output and netkan paths are relative to workspace
+	cmd.Dir = workspaceDir
+	fmt.Println(strings.Join(append(printed, netkanFile), " "))
 
 	out, err := cmd.CombinedOutput()
 
@@ -0,0 +1,427 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryanuber/columnize"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneOlderThan string
+	pruneMaxSize   string
+	pruneKeep      int
+	pruneDryRun    = false
+)
+
+// cacheArea is part of workspace cache
+type cacheArea struct {
+	name string
+	path string
+	// items of prunable areas can be removed by `kure cache prune`
+	prunable bool
+	// shared areas are used by other workspaces too, they are pruned only
+	// when named explicitly
+	shared bool
+}
+
+// cacheItem is single file or directory in cache area
+type cacheItem struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and prune workspace caches",
+	Long: `Workspace keeps downloaded repos, snapshots of repo archives, mod archives downloaded by
+	netkan.exe, packed server repository and netkan.exe binaries in cache directory.`,
+}
+
+var cacheStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show size, age and item count of every cache area",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		areas, err := cacheAreas()
+		if err != nil {
+			return err
+		}
+		result := []string{"area | size | items | newest | oldest | path"}
+		for _, a := range areas {
+			items, err := a.items()
+			if err != nil {
+				return err
+			}
+			var size int64
+			newest, oldest := "-", "-"
+			for _, i := range items {
+				size += i.size
+			}
+			if len(items) > 0 {
+				newest = formatAge(items[0].modTime)
+				oldest = formatAge(items[len(items)-1].modTime)
+			}
+			result = append(result, fmt.Sprintf("%s | %s | %d | %s | %s | %s",
+				a.name, formatSize(size), len(items), newest, oldest, a.path))
+		}
+		fmt.Println(columnize.SimpleFormat(result))
+		return nil
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune [area...]",
+	Short: "Remove old items from cache",
+	Long: `Remove items from snapshot, download and shared cache areas. Without arguments all of them are pruned,
+	except areas of shared cache, which other workspaces use too. Name them to prune them.
+	Snapshots recorded in kure.lock are never removed.
+	Examples:
+	"kure cache prune --older-than 30d" removes items not modified in last 30 days
+	"kure cache prune --max-size 2G download" removes oldest mod archives until area fits in 2 GiB
+	"kure cache prune --keep 2" keeps only two newest mod archives of every mod`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		mode := exclusiveLock
+		if pruneDryRun {
+			mode = sharedLock
+		}
+		if c := lockWorkspace(mode); c != nil {
+			return c
+		}
+		var maxAge time.Duration
+		var maxSize int64 = -1
+		var err error
+		if pruneOlderThan != "" {
+			maxAge, err = parseAge(pruneOlderThan)
+			if err != nil {
+				return err
+			}
+		}
+		if pruneMaxSize != "" {
+			maxSize, err = parseSize(pruneMaxSize)
+			if err != nil {
+				return err
+			}
+		}
+		if maxAge == 0 && maxSize < 0 && pruneKeep <= 0 {
+			return errors.New("Set at least one of --older-than, --max-size or --keep")
+		}
+		areas, err := cacheAreas()
+		if err != nil {
+			return err
+		}
+		for _, name := range args {
+			if !hasCacheArea(areas, name) {
+				return fmt.Errorf("Unknown cache area `%s`", name)
+			}
+		}
+		locked, err := lockedSnapshots()
+		if err != nil {
+			return err
+		}
+
+		var freed int64
+		var removed int
+		for _, a := range areas {
+			if len(args) > 0 && !contains(args, a.name) {
+				continue
+			}
+			if !a.prunable {
+				if len(args) > 0 {
+					return fmt.Errorf("Cache area `%s` can't be pruned", a.name)
+				}
+				continue
+			}
+			if a.shared && len(args) == 0 {
+				continue
+			}
+			items, err := a.items()
+			if err != nil {
+				return err
+			}
+			var keep []cacheItem
+			for _, i := range items {
+				if (a.name == "snapshot" || a.name == "shared") && locked[strings.SplitN(filepath.Base(i.path), ".", 2)[0]] {
+					continue
+				}
+				keep = append(keep, i)
+			}
+			var drop []cacheItem
+			if pruneKeep > 0 && a.name == "download" {
+				keep, drop = pruneByIdentifier(keep, pruneKeep)
+			}
+			if maxAge > 0 {
+				var old []cacheItem
+				keep, old = pruneByAge(keep, maxAge)
+				drop = append(drop, old...)
+			}
+			if maxSize >= 0 {
+				var big []cacheItem
+				keep, big = pruneBySize(keep, maxSize)
+				drop = append(drop, big...)
+			}
+			for _, i := range drop {
+				if pruneDryRun {
+					fmt.Printf("Would remove %s (%s)\n", i.path, formatSize(i.size))
+				} else {
+					if verbose {
+						fmt.Printf("Removing %s (%s)\n", i.path, formatSize(i.size))
+					}
+					err = os.RemoveAll(i.path)
+					if err != nil {
+						return err
+					}
+				}
+				freed += i.size
+				removed++
+			}
+		}
+		if pruneDryRun {
+			Done("Would remove %d items, %s\n", removed, formatSize(freed))
+		} else {
+			Done("Removed %d items, %s\n", removed, formatSize(freed))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheStatusCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cachePruneCmd.Flags().StringVarP(&pruneOlderThan, "older-than", "o", "",
+		`Remove items older than given age, for example "72h" or "30d"`)
+	cachePruneCmd.Flags().StringVarP(&pruneMaxSize, "max-size", "s", "",
+		`Remove oldest items until area is smaller than given size, for example "500M" or "2G"`)
+	cachePruneCmd.Flags().IntVarP(&pruneKeep, "keep", "k", 0,
+		"Keep only given number of newest mod archives of every mod")
+	cachePruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "d", false, "Only show what would be removed")
+}
+
+func cacheAreas() ([]cacheArea, error) {
+	download, err := downloadDir()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedBlobs()
+	if err != nil {
+		return nil, err
+	}
+	areas := []cacheArea{
+		{name: "repo", path: workspacePath("cache", "repo")},
+		{name: "snapshot", path: workspacePath("cache", "snapshot"), prunable: true},
+		{name: "download", path: download, prunable: true, shared: shared != nil},
+		{name: "server", path: workspacePath("cache", "server")},
+		{name: "mirror", path: workspacePath("cache", "mirror")},
+		{name: "netkan", path: workspacePath("cache", "bin")},
+	}
+	if shared != nil {
+		// every workspace keeps own copy of its snapshots, so pruned blobs
+		// are only downloaded again
+		areas = append(areas, cacheArea{name: "shared", path: shared.dir, prunable: true, shared: true})
+	}
+	return areas, nil
+}
+
+func hasCacheArea(areas []cacheArea, name string) bool {
+	for _, a := range areas {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// items returns top level entries of area, newest first
+func (a cacheArea) items() ([]cacheItem, error) {
+	entries, err := ioutil.ReadDir(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var items []cacheItem
+	for _, e := range entries {
+		// hidden files and unfinished downloads are not cache items
+		if strings.HasPrefix(e.Name(), ".") || strings.HasPrefix(e.Name(), "download-") {
+			continue
+		}
+		path := filepath.Join(a.path, e.Name())
+		size := e.Size()
+		if e.IsDir() {
+			size, err = dirSize(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, cacheItem{path: path, size: size, modTime: e.ModTime()})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].modTime.After(items[j].modTime)
+	})
+	return items, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.Mode().IsRegular() {
+			size += f.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// lockedSnapshots returns hashes of snapshots recorded in kure.lock
+func lockedSnapshots() (map[string]bool, error) {
+	result := make(map[string]bool)
+	if _, err := os.Stat(lockFilePath()); os.IsNotExist(err) {
+		return result, nil
+	}
+	lock, err := loadLockFile()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range lock.Repos {
+		if r.SHA256 != "" {
+			result[r.SHA256] = true
+		}
+	}
+	return result, nil
+}
+
+// netkan.exe names downloaded files like "1A2B3C4D-ModName-1.2.3.zip"
+var archiveIdentifier = regexp.MustCompile(`^(?:[0-9A-Fa-f]{8}-)?(.+?)(?:[-_ ]v?\d.*)?$`)
+
+// pruneByIdentifier keeps n newest mod archives of every mod. Items must be
+// sorted newest first. Items with no recognizable mod name are kept.
+func pruneByIdentifier(items []cacheItem, n int) (keep, drop []cacheItem) {
+	count := make(map[string]int)
+	for _, i := range items {
+		name := filepath.Base(i.path)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		match := archiveIdentifier.FindStringSubmatch(name)
+		if match == nil {
+			keep = append(keep, i)
+			continue
+		}
+		id := strings.ToLower(match[1])
+		count[id]++
+		if count[id] > n {
+			drop = append(drop, i)
+		} else {
+			keep = append(keep, i)
+		}
+	}
+	return keep, drop
+}
+
+func pruneByAge(items []cacheItem, maxAge time.Duration) (keep, drop []cacheItem) {
+	limit := time.Now().Add(-maxAge)
+	for _, i := range items {
+		if i.modTime.Before(limit) {
+			drop = append(drop, i)
+		} else {
+			keep = append(keep, i)
+		}
+	}
+	return keep, drop
+}
+
+// pruneBySize keeps newest items that fit in maxSize. Items must be sorted
+// newest first.
+func pruneBySize(items []cacheItem, maxSize int64) (keep, drop []cacheItem) {
+	var total int64
+	for _, i := range items {
+		if total+i.size > maxSize {
+			drop = append(drop, i)
+		} else {
+			total += i.size
+			keep = append(keep, i)
+		}
+	}
+	return keep, drop
+}
+
+// parseAge parses time.Duration with additional "d" (days) unit
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid age `%s`", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid age `%s`", s)
+	}
+	return d, nil
+}
+
+// parseSize parses size like "512K", "500M" or "2G". Units are powers of 1024.
+func parseSize(s string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	var mul int64 = 1
+	if len(num) > 0 {
+		if u, found := units[num[len(num)-1:]]; found {
+			mul = u
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size `%s`", s)
+	}
+	return int64(n * float64(mul)), nil
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatAge(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// servedChannels returns channels from config, or main channel with local
+// ckans and optional curation.json when there are none. With overlay all
+// channels are packed over downloaded ckan repos.
+func servedChannels(overlay bool) []channelConfig {
+	if len(conf.Channels) == 0 {
+		return []channelConfig{{Name: "main", Overlay: overlay, Curation: curationFile, implicit: true}}
+	}
+	channels := append([]channelConfig{}, conf.Channels...)
+	for i := range channels {
+		channels[i].Overlay = channels[i].Overlay || overlay
+	}
+	return channels
+}
+
+// findChannel returns served channel with given name, first one when name
+// is empty
+func findChannel(name string, overlay bool) (channelConfig, error) {
+	channels := servedChannels(overlay)
+	if name == "" {
+		return channels[0], nil
+	}
+	var names []string
+	for _, ch := range channels {
+		if ch.Name == name {
+			return ch, nil
+		}
+		names = append(names, ch.Name)
+	}
+	return channelConfig{}, fmt.Errorf("There is no channel %s, available: %s", name, strings.Join(names, ", "))
+}
+
+// archive is file name of channel repository
+func (ch channelConfig) archive() string {
+	return ch.Name + ".tar.gz"
+}
+
+// dirs returns absolute directories with local ckans of channel
+func (ch channelConfig) dirs() []string {
+	if len(ch.Dirs) == 0 {
+		return []string{workspacePath("local", "ckan")}
+	}
+	var dirs []string
+	for _, d := range ch.Dirs {
+		dirs = append(dirs, workspaceAbs(d))
+	}
+	return dirs
+}
+
+// filter keeps entries with identifiers matching include patterns and none
+// of exclude patterns
+func (ch channelConfig) filter(entries []repoEntry) []repoEntry {
+	if len(ch.Include) == 0 && len(ch.Exclude) == 0 {
+		return entries
+	}
+	var result []repoEntry
+	for _, e := range entries {
+		if (len(ch.Include) == 0 || matchesAny(ch.Include, e.identifier)) && !matchesAny(ch.Exclude, e.identifier) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (ch channelConfig) loadCuration() (*curation, error) {
+	if ch.Curation == "" {
+		return nil, nil
+	}
+	return loadCuration(ch.Curation, !ch.implicit)
+}
+
+// watched lists files and directories packed into channel
+func (ch channelConfig) watched() []string {
+	paths := ch.dirs()
+	curated := false
+	if ch.Curation != "" {
+		paths = append(paths, workspaceAbs(ch.Curation))
+		_, err := os.Stat(workspaceAbs(ch.Curation))
+		curated = err == nil
+	}
+	if ch.Overlay || curated {
+		// `kure update` writes state after downloaded repos are in place, so
+		// huge repos like CKAN-meta are not walked on every check
+		paths = append(paths, statePath())
+	}
+	return paths
+}
+
+// matchesAny reports whether identifier matches one of patterns, which are
+// checked when config is loaded
+func matchesAny(patterns []string, identifier string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, identifier); ok {
+			return true
+		}
+	}
+	return false
+}
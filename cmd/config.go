@@ -0,0 +1,709 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configVersion is version of kure.json format written by this kure.
+// Older files are migrated when loaded, see saveMigratedConfig.
+const configVersion = 1
+
+// envPrefix starts names of environment variables overriding kure.json
+const envPrefix = "KURE_"
+
+// config is workspace configuration from kure.json
+type config struct {
+	ConfigVersion   int          `json:"config_version"`
+	NetkanExe       string       `json:"netkan_exe"`
+	NetkanExeSHA256 string       `json:"netkan_exe_sha256,omitempty"`
+	CacheDir        string       `json:"cachedir"`
+	SharedCache     bool         `json:"shared_cache,omitempty"`
+	SharedCacheDir  string       `json:"shared_cache_dir,omitempty"`
+	MirrorRewrite   []mirrorRule `json:"mirror_rewrite,omitempty"`
+	// program running netkan.exe
+	NetkanRunner string `json:"netkan_runner,omitempty"`
+	// environment variable with GitHub token passed to netkan.exe. It's
+	// passed as command line argument, so other users can see it in process
+	// list.
+	GitHubTokenEnv string `json:"github_token_env,omitempty"`
+	// number of netkans built at once
+	BuildJobs int  `json:"build_jobs,omitempty"`
+	NoColor   bool `json:"no_color,omitempty"`
+	// identifiers losing all upstream versions in `kure serve --overlay`
+	OverlayDropUpstream []string `json:"overlay_drop_upstream,omitempty"`
+	// download url prefix replaced like kure:// with url of local/files
+	FilesPlaceholder string       `json:"files_placeholder,omitempty"`
+	Repos            []repoConfig `json:"repos"`
+	// repositories served by `kure serve`, just main one when empty
+	Channels []channelConfig `json:"channels,omitempty"`
+	// credentials clients must send to `kure serve`, bearer or basic
+	ServeAuth *authConfig `json:"serve_auth,omitempty"`
+	// origin of top level settings and repos: default, user, file or env
+	origin map[string]string
+}
+
+// repoConfig is single repository from kure.json
+type repoConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// source kind, guessed from url when empty
+	Source string `json:"source,omitempty"`
+	URL    string `json:"url"`
+	// branch, tag or commit for git repos
+	Ref string `json:"ref,omitempty"`
+	// urls tried in order when url fails
+	Mirrors []string `json:"mirrors,omitempty"`
+	// nil for public repos
+	Auth *authConfig `json:"auth,omitempty"`
+}
+
+// channelConfig is repository served by `kure serve` as name.tar.gz
+type channelConfig struct {
+	Name string `json:"name"`
+	// directories with ckans, relative to workspace; local/ckan by default
+	Dirs []string `json:"dirs,omitempty"`
+	// identifier patterns like "Kopernicus*"; empty include everything
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// pack ckans over downloaded ckan repos
+	Overlay bool `json:"overlay,omitempty"`
+	// curation file relative to workspace, see curation
+	Curation string `json:"curation,omitempty"`
+	// main channel used when kure.json has no channels, its curation file
+	// is optional
+	implicit bool
+}
+
+// channelName is allowed name of channel, used in url and file name
+var channelName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// authConfig references credentials of repo, see repoAuth
+type authConfig struct {
+	Type        string `json:"type"`
+	TokenEnv    string `json:"token_env,omitempty"`
+	UsernameEnv string `json:"username_env,omitempty"`
+	PasswordEnv string `json:"password_env,omitempty"`
+	Netrc       string `json:"netrc,omitempty"`
+}
+
+// mirrorRule rewrites urls starting with From to start with To
+type mirrorRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// configMigrations[v] upgrades kure.json from version v to v+1. They edit
+// file in place, so user formatting is kept.
+var configMigrations = []func(data []byte) ([]byte, error){
+	// 0: files written before config_version was introduced
+	func(data []byte) ([]byte, error) {
+		return setJSONKey(data, "config_version", 1)
+	},
+}
+
+// userConfigFile is path of user config. Its settings are layered under
+// kure.json of every workspace, repos of both files are merged.
+var userConfigFile string
+
+// userConfig is content of userConfigFile, nil if user has none
+var userConfig []byte
+
+// userConfigPath returns $XDG_CONFIG_HOME/kure/config.json or platform
+// equivalent
+func userConfigPath() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "kure", "config.json"), nil
+}
+
+// loadUserConfig reads and checks user config. It returns nil if user has
+// none.
+func loadUserConfig() (*config, error) {
+	path, err := userConfigPath()
+	if err != nil {
+		return nil, nil // nowhere to look
+	}
+	userConfigFile = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c, _, err := parseConfigLayer(path, data)
+	if err != nil {
+		return nil, err
+	}
+	userConfig = data
+	return c, nil
+}
+
+// loadConfig reads, migrates and validates config file
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	var raw map[string]interface{}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, jsonError(name, data, err)
+	}
+
+	version := 0
+	if v, found := raw["config_version"].(float64); found {
+		version = int(v)
+	}
+	if version > configVersion {
+		return nil, fmt.Errorf("%s has config_version %d, this kure supports up to %d. Update kure", name, version, configVersion)
+	}
+	if version < configVersion {
+		for v := version; v < configVersion; v++ {
+			data, err = configMigrations[v](data)
+			if err != nil {
+				return nil, fmt.Errorf("Could not migrate %s to config_version %d: %s", name, v+1, err)
+			}
+		}
+		original, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		migratedConfig = &configMigration{path: path, from: version, original: original, data: data}
+	}
+	return parseConfig(name, data)
+}
+
+// migratedConfig is kure.json upgraded by loadConfig. It's kept in memory
+// until command takes exclusive workspace lock, so file is never rewritten
+// under other running kure.
+var migratedConfig *configMigration
+
+type configMigration struct {
+	path     string
+	from     int
+	original []byte
+	data     []byte
+	// user was told config is migrated only in memory
+	warned bool
+}
+
+// saveMigratedConfig writes migrated config if workspace is locked
+// exclusively, otherwise it tells user once that config was migrated in memory
+func saveMigratedConfig(mode lockMode) error {
+	m := migratedConfig
+	if m == nil {
+		return nil
+	}
+	name := filepath.Base(m.path)
+	if mode != exclusiveLock {
+		if m.warned {
+			return nil
+		}
+		m.warned = true
+		Warn("%s has config_version %d, it's migrated to %d in memory only. Command that changes workspace, like `kure update`, will save it\n",
+			name, m.from, configVersion)
+		return nil
+	}
+	migratedConfig = nil
+	current, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, m.original) {
+		// changed by other kure before lock was taken, next run migrates it
+		return nil
+	}
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(m.path, m.data, info.Mode())
+	if err != nil {
+		return err
+	}
+	Warn("Migrated %s from config_version %d to %d\n", name, m.from, configVersion)
+	return nil
+}
+
+// parseConfig decodes workspace config layered over user config, applies
+// environment overrides and validates result
+func parseConfig(name string, data []byte) (*config, error) {
+	merged := make(map[string]interface{})
+	origin := make(map[string]string)
+	if userConfig != nil {
+		_, raw, err := parseConfigLayer(userConfigFile, userConfig)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfig(merged, raw, "user", origin)
+	}
+	_, raw, err := parseConfigLayer(name, data)
+	if err != nil {
+		return nil, err
+	}
+	mergeConfig(merged, raw, "file", origin)
+
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{origin: origin}
+	err = json.Unmarshal(encoded, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.CacheDir == "" {
+		c.CacheDir = "./cache/download/"
+	}
+	if c.NetkanRunner == "" {
+		c.NetkanRunner = "mono"
+	}
+	if c.BuildJobs == 0 {
+		c.BuildJobs = 1
+	}
+	err = c.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	// environment overrides were not checked with config files
+	errs := newConfigErrors(name, data)
+	errs.origin = origin
+	c.validate(errs)
+	if c.NetkanExe == "" {
+		errs.add("netkan_exe", "missing url of netkan.exe")
+	}
+	if len(errs.list) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// parseConfigLayer checks single config file. Settings required in merged
+// config may be missing.
+func parseConfigLayer(name string, data []byte) (*config, map[string]interface{}, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, jsonError(name, data, err)
+	}
+	errs := newConfigErrors(name, data)
+	checkKeys(raw, reflect.TypeOf(config{}), "", errs)
+	if len(errs.list) > 0 {
+		return nil, nil, errs
+	}
+	c := &config{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, nil, jsonError(name, data, err)
+	}
+	c.validate(errs)
+	if len(errs.list) > 0 {
+		return nil, nil, errs
+	}
+	return c, raw, nil
+}
+
+// mergeConfig puts settings of src layer over dst. Repos of src come first,
+// followed by repos of dst with other names.
+func mergeConfig(dst, src map[string]interface{}, layer string, origin map[string]string) {
+	for key, value := range src {
+		origin[key] = layer
+		if key != "repos" {
+			dst[key] = value
+			continue
+		}
+		old, _ := dst["repos"].([]interface{})
+		var oldOrigin []string
+		for i := range old {
+			oldOrigin = append(oldOrigin, origin[fmt.Sprintf("repos[%d]", i)])
+		}
+		repos, _ := value.([]interface{})
+		names := make(map[interface{}]bool)
+		for i, r := range repos {
+			if r, ok := r.(map[string]interface{}); ok {
+				names[r["name"]] = true
+			}
+			origin[fmt.Sprintf("repos[%d]", i)] = layer
+		}
+		for i, r := range old {
+			if r, ok := r.(map[string]interface{}); ok && names[r["name"]] {
+				continue
+			}
+			origin[fmt.Sprintf("repos[%d]", len(repos))] = oldOrigin[i]
+			repos = append(repos, r)
+		}
+		dst[key] = repos
+	}
+}
+
+// applyEnv overrides top level settings with KURE_ variables, for example
+// KURE_NETKAN_EXE overrides netkan_exe
+func (c *config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := configKey(v.Type().Field(i))
+		if key == "" || key == "config_version" {
+			continue
+		}
+		env := envPrefix + strings.ToUpper(key)
+		value, found := os.LookupEnv(env)
+		if !found {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false, got `%s`", env, value)
+			}
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got `%s`", env, value)
+			}
+			f.SetInt(int64(n))
+		default:
+			// lists can only be set in kure.json
+			continue
+		}
+		c.origin[key] = "env"
+	}
+	return nil
+}
+
+// configKey returns json name of config field, empty for unexported fields
+func configKey(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	return strings.Split(f.Tag.Get("json"), ",")[0]
+}
+
+func (c *config) validate(errs *configErrors) {
+	if c.BuildJobs < 0 {
+		errs.add("build_jobs", "must be at least 1")
+	}
+	for i, r := range c.MirrorRewrite {
+		path := fmt.Sprintf("mirror_rewrite[%d]", i)
+		if r.From == "" {
+			errs.add(path, "missing from")
+		}
+		if r.To == "" {
+			errs.add(path, "missing to")
+		}
+	}
+	channels := make(map[string]int)
+	for i, ch := range c.Channels {
+		path := fmt.Sprintf("channels[%d]", i)
+		if ch.Name == "" {
+			errs.add(path, "missing name")
+		} else if !channelName.MatchString(ch.Name) {
+			errs.add(path+".name", "may contain only letters, digits, dots, dashes and underscores, got `%s`", ch.Name)
+		} else if j, found := channels[ch.Name]; found {
+			errs.add(path+".name", "name `%s` already used by channels[%d]", ch.Name, j)
+		} else {
+			channels[ch.Name] = i
+		}
+		for j, p := range ch.Include {
+			if _, err := filepath.Match(p, ""); err != nil {
+				errs.add(fmt.Sprintf("%s.include[%d]", path, j), "bad pattern `%s`", p)
+			}
+		}
+		for j, p := range ch.Exclude {
+			if _, err := filepath.Match(p, ""); err != nil {
+				errs.add(fmt.Sprintf("%s.exclude[%d]", path, j), "bad pattern `%s`", p)
+			}
+		}
+	}
+	names := make(map[string]int)
+	for i, r := range c.Repos {
+		path := fmt.Sprintf("repos[%d]", i)
+		if r.Name == "" {
+			errs.add(path, "missing name")
+		} else if j, found := names[r.Name]; found {
+			errs.add(path+".name", "name `%s` already used by repos[%d]", r.Name, j)
+		} else {
+			names[r.Name] = i
+		}
+		if r.Type == "" {
+			errs.add(path, "missing type")
+		} else if r.Type != "ckan" && r.Type != "netkan" {
+			errs.add(path+".type", "must be ckan or netkan, got `%s`", r.Type)
+		}
+		if r.URL == "" {
+			errs.add(path, "missing url")
+		}
+		switch r.Source {
+		case "", "tar.gz", "tgz", "zip", "dir", "git":
+		default:
+			errs.add(path+".source", "must be tar.gz, zip, dir or git, got `%s`", r.Source)
+		}
+		if r.Ref != "" && r.Source != "git" {
+			errs.add(path+".ref", "only git repos can be pinned to ref")
+		}
+		if r.Auth != nil {
+			r.Auth.validate(path+".auth", true, errs)
+		}
+	}
+	if c.ServeAuth != nil {
+		c.ServeAuth.validate("serve_auth", false, errs)
+	}
+}
+
+// validate checks auth at path of config. Netrc can only be used for
+// sending credentials.
+func (a *authConfig) validate(path string, netrc bool, errs *configErrors) {
+	switch a.Type {
+	case "bearer":
+		if a.TokenEnv == "" {
+			errs.add(path, "bearer auth needs token_env")
+		}
+	case "basic":
+		if a.UsernameEnv == "" || a.PasswordEnv == "" {
+			errs.add(path, "basic auth needs username_env and password_env")
+		}
+	case "netrc":
+		if !netrc {
+			errs.add(path+".type", "must be bearer or basic, got `%s`", a.Type)
+		}
+	default:
+		if netrc {
+			errs.add(path+".type", "must be bearer, basic or netrc, got `%s`", a.Type)
+		} else {
+			errs.add(path+".type", "must be bearer or basic, got `%s`", a.Type)
+		}
+	}
+}
+
+// checkKeys reports keys of raw json that are not fields of type t
+func checkKeys(raw interface{}, t reflect.Type, path string, errs *configErrors) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return // type errors are reported by decoder
+		}
+		fields := make(map[string]reflect.Type)
+		var names []string
+		for i := 0; i < t.NumField(); i++ {
+			name := configKey(t.Field(i))
+			if name == "" {
+				continue
+			}
+			fields[name] = t.Field(i).Type
+			names = append(names, name)
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			keyPath := joinConfigPath(path, k)
+			ft, found := fields[k]
+			if !found {
+				if s := suggest(k, names); s != "" {
+					errs.add(keyPath, "unknown key, did you mean `%s`?", s)
+				} else {
+					errs.add(keyPath, "unknown key")
+				}
+				continue
+			}
+			checkKeys(obj[k], ft, keyPath, errs)
+		}
+	case reflect.Slice:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i, v := range arr {
+			checkKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// suggest returns name most similar to key, if any is close enough
+func suggest(key string, names []string) string {
+	best, bestDist := "", len(key)/2+1
+	for _, n := range names {
+		if d := levenshtein(key, n); d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// configErrors collects problems found in config file. Every problem is
+// reported with line and column of related value.
+type configErrors struct {
+	file    string
+	data    []byte
+	offsets map[string]int
+	// origin of merged config settings, problems of settings from
+	// environment are reported with variable name
+	origin map[string]string
+	list   []string
+}
+
+func newConfigErrors(file string, data []byte) *configErrors {
+	return &configErrors{file: file, data: data, offsets: jsonOffsets(data)}
+}
+
+// add records problem with value at path. If path does not exist, location
+// of closest parent is used.
+func (e *configErrors) add(path, format string, args ...interface{}) {
+	key := strings.FieldsFunc(path, func(r rune) bool { return r == '.' || r == '[' })
+	if len(key) > 0 && e.origin[key[0]] == "env" {
+		e.list = append(e.list, fmt.Sprintf("%s%s: %s", envPrefix, strings.ToUpper(key[0]), fmt.Sprintf(format, args...)))
+		return
+	}
+	loc := path
+	offset, found := e.offsets[loc]
+	for !found && loc != "" {
+		if i := strings.LastIndexAny(loc, ".["); i >= 0 {
+			loc = loc[:i]
+		} else {
+			loc = ""
+		}
+		offset, found = e.offsets[loc]
+	}
+	line, col := lineCol(e.data, offset)
+	e.list = append(e.list, fmt.Sprintf("%s:%d:%d: %s: %s", e.file, line, col, path, fmt.Sprintf(format, args...)))
+}
+
+func (e *configErrors) Error() string {
+	return fmt.Sprintf("Invalid %s:\n  %s", e.file, strings.Join(e.list, "\n  "))
+}
+
+// decoder writes array indexes like repos.1.url
+var arrayIndex = regexp.MustCompile(`\.(\d+)`)
+
+// jsonError adds location to errors returned by json decoder
+func jsonError(file string, data []byte, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// offset is after the bad character
+		line, col := lineCol(data, int(e.Offset)-1)
+		return fmt.Errorf("Invalid %s:\n  %s:%d:%d: %s", file, file, line, col, e)
+	case *json.UnmarshalTypeError:
+		field := arrayIndex.ReplaceAllString(e.Field, "[$1]")
+		// offset is after the value, point at its start when it can be found
+		offset, found := jsonOffsets(data)[field]
+		if !found {
+			offset = int(e.Offset)
+		}
+		line, col := lineCol(data, offset)
+		return fmt.Errorf("Invalid %s:\n  %s:%d:%d: %s: expected %s, got %s", file, file, line, col, field, e.Type, e.Value)
+	}
+	return fmt.Errorf("Invalid %s: %s", file, err)
+}
+
+func lineCol(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := offset - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// jsonOffsets returns offsets of all values in json document, by path like
+// repos[1].name. Root is empty path.
+func jsonOffsets(data []byte) map[string]int {
+	offsets := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	walkJSON(dec, data, "", offsets)
+	return offsets
+}
+
+func walkJSON(dec *json.Decoder, data []byte, path string, offsets map[string]int) error {
+	offsets[path] = skipJSONSeparators(data, int(dec.InputOffset()))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			err = walkJSON(dec, data, joinConfigPath(path, fmt.Sprint(key)), offsets)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			err = walkJSON(dec, data, path+"["+strconv.Itoa(i)+"]", offsets)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
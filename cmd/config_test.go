@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withUserConfig sets user config layer for the test
+func withUserConfig(t *testing.T, data string) {
+	t.Helper()
+	oldData, oldFile := userConfig, userConfigFile
+	t.Cleanup(func() { userConfig, userConfigFile = oldData, oldFile })
+	userConfigFile = "config.json"
+	userConfig = nil
+	if data != "" {
+		userConfig = []byte(data)
+	}
+}
+
+func TestConfigErrorLocations(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "invalid value",
+			data: "{\n    \"netkan_exe\": \"x\",\n    \"repos\": [{\"name\": \"a\", \"type\": \"bad\", \"url\": \"u\"}]\n}",
+			want: "kure.json:3:37: repos[0].type: must be ckan or netkan, got `bad`",
+		},
+		{
+			name: "missing key reported at parent",
+			data: "{\n    \"netkan_exe\": \"x\",\n    \"repos\": [\n        {\"name\": \"a\", \"type\": \"ckan\"}\n    ]\n}",
+			want: "kure.json:4:9: repos[0]: missing url",
+		},
+		{
+			name: "duplicate name",
+			data: "{\"repos\": [{\"name\": \"a\", \"type\": \"ckan\", \"url\": \"u\"},\n{\"name\": \"a\", \"type\": \"ckan\", \"url\": \"u\"}]}",
+			want: "kure.json:2:10: repos[1].name: name `a` already used by repos[0]",
+		},
+		{
+			name: "unknown key with suggestion",
+			data: "{\n  \"netkan_ex\": \"x\"\n}",
+			want: "kure.json:2:16: netkan_ex: unknown key, did you mean `netkan_exe`?",
+		},
+		{
+			name: "unknown nested key with suggestion",
+			data: "{\"repos\": [{\"name\": \"a\", \"tpye\": \"ckan\"}]}",
+			want: "repos[0].tpye: unknown key, did you mean `type`?",
+		},
+		{
+			name: "unknown key without suggestion",
+			data: "{\"something\": 1}",
+			want: "kure.json:1:15: something: unknown key",
+		},
+		{
+			name: "syntax error",
+			data: "{\n    \"netkan_exe\": \"x\",\n}",
+			want: "kure.json:3:1: invalid character '}'",
+		},
+		{
+			name: "empty file",
+			data: "",
+			want: "kure.json:1:1: unexpected end of JSON input",
+		},
+		{
+			name: "nested type error",
+			data: "{\"repos\": [{\"name\": 1}]}",
+			want: "kure.json:1:21: repos[0].name: expected string, got number",
+		},
+		{
+			name: "type error",
+			data: "{\n    \"build_jobs\": \"four\"\n}",
+			want: "kure.json:2:19: build_jobs: expected int, got string",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseConfigLayer("kure.json", []byte(tt.data))
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error is\n%s\nwant it to contain\n%s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	names := []string{"netkan_exe", "cachedir", "repos"}
+	tests := map[string]string{
+		"netkan_exe":  "netkan_exe",
+		"netkanexe":   "netkan_exe",
+		"cache_dir":   "cachedir",
+		"repo":        "repos",
+		"mirrors":     "",
+		"overlay_xyz": "",
+	}
+	for key, want := range tests {
+		if got := suggest(key, names); got != want {
+			t.Errorf("suggest(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if d := levenshtein("kitten", "sitting"); d != 3 {
+		t.Errorf("levenshtein(kitten, sitting) = %d, want 3", d)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	withUserConfig(t, "")
+	data := []byte(`{"netkan_exe": "x", "build_jobs": 2, "repos": []}`)
+	t.Setenv("KURE_NETKAN_EXE", "y")
+	t.Setenv("KURE_BUILD_JOBS", "4")
+	t.Setenv("KURE_NO_COLOR", "true")
+	c, err := parseConfig("kure.json", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.NetkanExe != "y" || c.BuildJobs != 4 || !c.NoColor {
+		t.Errorf("environment not applied: netkan_exe %q, build_jobs %d, no_color %v", c.NetkanExe, c.BuildJobs, c.NoColor)
+	}
+	for key, want := range map[string]string{"netkan_exe": "env", "build_jobs": "env", "repos": "file"} {
+		if c.origin[key] != want {
+			t.Errorf("origin of %s is %q, want %q", key, c.origin[key], want)
+		}
+	}
+
+	tests := []struct {
+		env, value, want string
+	}{
+		{"KURE_BUILD_JOBS", "four", "KURE_BUILD_JOBS must be a number, got `four`"},
+		{"KURE_BUILD_JOBS", "-3", "KURE_BUILD_JOBS: must be at least 1"},
+		{"KURE_NO_COLOR", "maybe", "KURE_NO_COLOR must be true or false, got `maybe`"},
+		{"KURE_NETKAN_EXE", "", "KURE_NETKAN_EXE: missing url of netkan.exe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := parseConfig("kure.json", data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error is %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserConfigMerge(t *testing.T) {
+	withUserConfig(t, `{
+    "netkan_exe": "user.exe",
+    "build_jobs": 3,
+    "repos": [
+        {"name": "a", "type": "ckan", "url": "user-a"},
+        {"name": "b", "type": "ckan", "url": "user-b"}
+    ]
+}`)
+	c, err := parseConfig("kure.json", []byte(`{
+    "build_jobs": 5,
+    "repos": [
+        {"name": "b", "type": "ckan", "url": "file-b"},
+        {"name": "c", "type": "netkan", "url": "file-c"}
+    ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.NetkanExe != "user.exe" || c.BuildJobs != 5 {
+		t.Errorf("netkan_exe %q, build_jobs %d, want user.exe and 5", c.NetkanExe, c.BuildJobs)
+	}
+	var urls []string
+	for _, r := range c.Repos {
+		urls = append(urls, r.URL)
+	}
+	// workspace repos first, user repos with other names after them
+	if want := []string{"file-b", "file-c", "user-a"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("repos are %v, want %v", urls, want)
+	}
+	want := map[string]string{
+		"netkan_exe": "user",
+		"build_jobs": "file",
+		"repos[0]":   "file",
+		"repos[1]":   "file",
+		"repos[2]":   "user",
+	}
+	for key, w := range want {
+		if c.origin[key] != w {
+			t.Errorf("origin of %s is %q, want %q", key, c.origin[key], w)
+		}
+	}
+}
+
+func TestConfigMigration(t *testing.T) {
+	withUserConfig(t, "")
+	t.Cleanup(func() { migratedConfig = nil })
+	path := filepath.Join(t.TempDir(), "kure.json")
+	original := "{\n  \"netkan_exe\": \"x\",\n  \"repos\": []\n}\n"
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ConfigVersion != configVersion {
+		t.Errorf("config_version is %d, want %d", c.ConfigVersion, configVersion)
+	}
+	read := func() string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// shared lock leaves file alone
+	if err := saveMigratedConfig(sharedLock); err != nil {
+		t.Fatal(err)
+	}
+	if read() != original {
+		t.Errorf("file written under shared lock:\n%s", read())
+	}
+	if err := saveMigratedConfig(exclusiveLock); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"netkan_exe\": \"x\",\n  \"repos\": [],\n  \"config_version\": 1\n}\n"
+	if read() != want {
+		t.Errorf("migrated file is\n%s\nwant\n%s", read(), want)
+	}
+
+	// file changed by someone else before lock was taken is kept
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	changed := strings.Replace(original, `"x"`, `"y"`, 1)
+	if err := ioutil.WriteFile(path, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveMigratedConfig(exclusiveLock); err != nil {
+		t.Fatal(err)
+	}
+	if read() != changed {
+		t.Errorf("changed file was overwritten:\n%s", read())
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"config_version": 99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("config from newer kure accepted")
+	}
+}
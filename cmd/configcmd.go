@@ -0,0 +1,463 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ryanuber/columnize"
+	"github.com/spf13/cobra"
+)
+
+var (
+	showOrigin = false
+	editUser   = false
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Read and edit settings in kure.json",
+	Long: `Keys are written like in kure.json, nested ones joined with dots and array
+	indexes in brackets, for example "netkan_exe" or "repos[0].url".
+	Settings from user config ($XDG_CONFIG_HOME/kure/config.json) are used unless kure.json
+	sets them too. Repos of both files are merged, kure.json wins when names are equal.
+	Top level settings can be overridden with environment variables prefixed with KURE_,
+	for example KURE_NETKAN_EXE or KURE_CACHEDIR.`,
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get key",
+	Short: "Print effective value of setting",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		if len(args) != 1 {
+			return errors.New("You need to provide key as argument!")
+		}
+		path := parseConfigPath(args[0])
+		_, err := configFieldType(path)
+		if err != nil {
+			return err
+		}
+		v, found := configValue(reflect.ValueOf(conf), path)
+		if !found {
+			return fmt.Errorf("`%s` is not set", args[0])
+		}
+		s, err := formatConfigValue(v, "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(s)
+		return nil
+	},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set key value",
+	Short: "Set value in kure.json",
+	Long: `Set value in kure.json, or in user config with --user. Strings are written
+	as given, lists and objects must be written as json, for example:
+	kure config set repos[0].mirrors '["https://mirror.example.com/meta.tar.gz"]'`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := configTarget()
+		if err != nil {
+			return err
+		}
+		if !editUser {
+			if c := lockWorkspace(exclusiveLock); c != nil {
+				return c
+			}
+		}
+		if len(args) != 2 {
+			return errors.New("You need to provide key and value as arguments!")
+		}
+		key := parseConfigPath(args[0])
+		if key[0] == "config_version" {
+			return errors.New("config_version is managed by kure")
+		}
+		t, err := configFieldType(key)
+		if err != nil {
+			return err
+		}
+		value, err := parseConfigValue(t, args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", args[0], err)
+		}
+		err = editConfigFile(path, func(data []byte) ([]byte, error) {
+			return setJSONPath(data, key, value)
+		})
+		if err != nil {
+			return err
+		}
+		Done("Set %s in %s\n", args[0], path)
+		warnOverride(key)
+		return nil
+	},
+}
+
+var configUnsetCmd = &cobra.Command{
+	Use:   "unset key",
+	Short: "Remove value from kure.json, so default is used",
+	Long:  `Remove value from kure.json, or from user config with --user.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := configTarget()
+		if err != nil {
+			return err
+		}
+		if !editUser {
+			if c := lockWorkspace(exclusiveLock); c != nil {
+				return c
+			}
+		}
+		if len(args) != 1 {
+			return errors.New("You need to provide key as argument!")
+		}
+		key := parseConfigPath(args[0])
+		if key[0] == "config_version" {
+			return errors.New("config_version is managed by kure")
+		}
+		_, err = configFieldType(key)
+		if err != nil {
+			return err
+		}
+		err = editConfigFile(path, func(data []byte) ([]byte, error) {
+			data, removed, err := deleteJSONPath(data, key)
+			if err == nil && !removed {
+				err = fmt.Errorf("`%s` is not set in %s", args[0], path)
+			}
+			return data, err
+		})
+		if err != nil {
+			return err
+		}
+		Done("Unset %s in %s\n", args[0], path)
+		warnOverride(key)
+		return nil
+	},
+}
+
+var configListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List effective settings",
+	Long: `List effective settings. With --origin shows where every value comes from:
+	default, user (user config), file (kure.json) or env (KURE_ variable).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		header := "key | value"
+		if showOrigin {
+			header += " | origin"
+		}
+		result := []string{header}
+		v := reflect.ValueOf(conf).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			key := configKey(v.Type().Field(i))
+			if key == "" {
+				continue
+			}
+			var data interface{}
+			encoded, err := json.Marshal(v.Field(i).Interface())
+			if err != nil {
+				return err
+			}
+			err = json.Unmarshal(encoded, &data)
+			if err != nil {
+				return err
+			}
+			if f := v.Field(i); f.Kind() == reflect.Slice && f.IsNil() {
+				data = []interface{}{}
+			}
+			list, isList := data.([]interface{})
+			if !isList || len(list) == 0 {
+				result = append(result, originLines(flattenConfig(key, data), key)...)
+				continue
+			}
+			// repos may come from different files
+			for j, e := range list {
+				elem := fmt.Sprintf("%s[%d]", key, j)
+				result = append(result, originLines(flattenConfig(elem, e), elem, key)...)
+			}
+		}
+		fmt.Println(columnize.SimpleFormat(result))
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configUnsetCmd)
+	configCmd.AddCommand(configListCmd)
+	configListCmd.Flags().BoolVarP(&showOrigin, "origin", "o", false, "Show where values come from")
+	configSetCmd.Flags().BoolVarP(&editUser, "user", "u", false, "Edit user config instead of kure.json")
+	configUnsetCmd.Flags().BoolVarP(&editUser, "user", "u", false, "Edit user config instead of kure.json")
+}
+
+// configTarget returns path of config file edited by set and unset
+func configTarget() (string, error) {
+	if !editUser {
+		if !inWorkspace {
+			return "", errors.New("This command can only be called from workspace! Use --user to edit user config.")
+		}
+		return confPath, nil
+	}
+	if userConfigFile == "" {
+		return "", errors.New("Could not find user config directory")
+	}
+	return userConfigFile, nil
+}
+
+// originLines adds origin of first found key to lines, if --origin is set
+func originLines(lines []string, keys ...string) []string {
+	if !showOrigin {
+		return lines
+	}
+	origin := "default"
+	for _, k := range keys {
+		if o, found := conf.origin[k]; found {
+			origin = o
+			break
+		}
+	}
+	for i := range lines {
+		lines[i] += " | " + origin
+	}
+	return lines
+}
+
+// parseConfigPath splits key like repos[0].url into its parts
+func parseConfigPath(key string) []string {
+	return strings.FieldsFunc(key, func(r rune) bool {
+		return r == '.' || r == '[' || r == ']'
+	})
+}
+
+// formatConfigPath joins path like it's written in error messages
+func formatConfigPath(path []string) string {
+	key := ""
+	for _, p := range path {
+		if _, err := strconv.Atoi(p); err == nil {
+			key += "[" + p + "]"
+		} else {
+			key = joinConfigPath(key, p)
+		}
+	}
+	return key
+}
+
+// configFieldType returns type of setting at path, or error with suggestion
+// for unknown keys
+func configFieldType(path []string) (reflect.Type, error) {
+	if len(path) == 0 {
+		return nil, errors.New("Empty key")
+	}
+	t := reflect.TypeOf(config{})
+	for i, key := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			var names []string
+			found := false
+			for j := 0; j < t.NumField(); j++ {
+				name := configKey(t.Field(j))
+				if name == "" {
+					continue
+				}
+				if name == key {
+					t, found = t.Field(j).Type, true
+					break
+				}
+				names = append(names, name)
+			}
+			if !found {
+				msg := fmt.Sprintf("Unknown key `%s`", formatConfigPath(path[:i+1]))
+				if s := suggest(key, names); s != "" {
+					msg += fmt.Sprintf(", did you mean `%s`?", s)
+				}
+				return nil, errors.New(msg)
+			}
+		case reflect.Slice:
+			if _, err := strconv.Atoi(key); err != nil {
+				return nil, fmt.Errorf("`%s` is a list, use index like %s[0]", formatConfigPath(path[:i]), formatConfigPath(path[:i]))
+			}
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("`%s` has no keys", formatConfigPath(path[:i]))
+		}
+	}
+	return t, nil
+}
+
+// configValue returns value at path. Path must be checked with
+// configFieldType first.
+func configValue(v reflect.Value, path []string) (reflect.Value, bool) {
+	for _, key := range path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Slice {
+			i, _ := strconv.Atoi(key)
+			if i < 0 || i >= v.Len() {
+				return v, false
+			}
+			v = v.Index(i)
+			continue
+		}
+		for j := 0; j < v.NumField(); j++ {
+			if configKey(v.Type().Field(j)) == key {
+				v = v.Field(j)
+				break
+			}
+		}
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return v, false
+	}
+	return v, true
+}
+
+// formatConfigValue prints strings as they are and everything else as json
+func formatConfigValue(v reflect.Value, indent string) (string, error) {
+	if v.Kind() == reflect.String {
+		return v.String(), nil
+	}
+	encoded, err := json.MarshalIndent(v.Interface(), "", indent)
+	return string(encoded), err
+}
+
+// parseConfigValue converts command line argument to value of type t
+func parseConfigValue(t reflect.Type, s string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return s, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("expected true or false")
+		}
+		return b, nil
+	case reflect.Int:
+		return strconv.Atoi(s)
+	}
+	// check type, but write value as user wrote it, without empty fields
+	err := json.Unmarshal([]byte(s), reflect.New(t).Interface())
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	return value, json.Unmarshal([]byte(s), &value)
+}
+
+// flattenConfig lists leaf values of json data as "key | value" lines
+func flattenConfig(key string, data interface{}) []string {
+	switch d := data.(type) {
+	case map[string]interface{}:
+		var lines []string
+		for _, k := range sortedKeys(d) {
+			lines = append(lines, flattenConfig(joinConfigPath(key, k), d[k])...)
+		}
+		return lines
+	case []interface{}:
+		if len(d) == 0 {
+			return []string{key + " | []"}
+		}
+		var lines []string
+		for i, e := range d {
+			lines = append(lines, flattenConfig(fmt.Sprintf("%s[%d]", key, i), e)...)
+		}
+		return lines
+	case nil:
+		return []string{key + " | null"}
+	case string:
+		if strings.HasSuffix(key, "url") || strings.Contains(key, "mirrors[") {
+			d = redactURL(d)
+		}
+		return []string{key + " | " + d}
+	}
+	return []string{fmt.Sprintf("%s | %v", key, data)}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// editConfigFile applies edit to kure.json or user config, creating the
+// latter when needed. Result is validated before it's written, unless file was
+// already invalid; then remaining problems are shown.
+func editConfigFile(path string, edit func(data []byte) ([]byte, error)) error {
+	user := path == userConfigFile
+	validate := func(data []byte) error {
+		if user {
+			_, _, err := parseConfigLayer(path, data)
+			return err
+		}
+		_, err := parseConfig(filepath.Base(path), data)
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if user && os.IsNotExist(err) {
+		data, err = []byte("{\n}\n"), os.MkdirAll(filepath.Dir(path), DirPerm)
+	}
+	if err != nil {
+		return err
+	}
+	wasValid := validate(data) == nil
+	data, err = edit(data)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	err = validate(data)
+	if err != nil {
+		if wasValid {
+			return err
+		}
+		Warn("%s is still not valid\n", path)
+		fmt.Println(err)
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	return ioutil.WriteFile(path, data, mode)
+}
+
+// warnOverride tells user that changed setting has no effect
+func warnOverride(key []string) {
+	env := envPrefix + strings.ToUpper(key[0])
+	if _, found := os.LookupEnv(env); found && len(key) == 1 {
+		Warn("%s is overridden by %s environment variable\n", key[0], env)
+	}
+	if editUser && conf != nil && conf.origin[key[0]] == "file" && key[0] != "repos" {
+		Warn("%s is overridden by %s\n", key[0], confPath)
+	}
+}
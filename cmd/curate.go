@@ -0,0 +1,373 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// curationFile lists mods served from workspace, see curation
+const curationFile = "curation.json"
+
+// curation selects mods of served repository. Entries use format of CKAN
+// relationships, for example {"name": "ModuleManager", "min_version": "4.0"}.
+type curation struct {
+	Include []ckanRelation `json:"include"`
+}
+
+// ckanRelation is relationship from ckan file, like entry of depends
+type ckanRelation struct {
+	Name       string         `json:"name,omitempty"`
+	Version    string         `json:"version,omitempty"`
+	MinVersion string         `json:"min_version,omitempty"`
+	MaxVersion string         `json:"max_version,omitempty"`
+	AnyOf      []ckanRelation `json:"any_of,omitempty"`
+}
+
+func (r ckanRelation) String() string {
+	if len(r.AnyOf) > 0 {
+		var names []string
+		for _, a := range r.AnyOf {
+			names = append(names, a.String())
+		}
+		return strings.Join(names, " or ")
+	}
+	switch {
+	case r.Version != "":
+		return r.Name + " " + r.Version
+	case r.MinVersion != "" && r.MaxVersion != "":
+		return fmt.Sprintf("%s %s-%s", r.Name, r.MinVersion, r.MaxVersion)
+	case r.MinVersion != "":
+		return r.Name + " >= " + r.MinVersion
+	case r.MaxVersion != "":
+		return r.Name + " <= " + r.MaxVersion
+	}
+	return r.Name
+}
+
+// matches reports whether ckan satisfies relation. Versions are checked only
+// for ckans with matching identifier, not for ones providing it.
+func (r ckanRelation) matches(e repoEntry) bool {
+	if e.identifier != r.Name {
+		return contains(e.provides, r.Name)
+	}
+	return r.matchesVersion(e)
+}
+
+// selects reports whether curated entry picks ckan. Only identifier counts, so
+// curating mod does not bring in other mods providing it.
+func (r ckanRelation) selects(e repoEntry) bool {
+	if len(r.AnyOf) > 0 {
+		for _, a := range r.AnyOf {
+			if a.selects(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return e.identifier == r.Name && r.matchesVersion(e)
+}
+
+func (r ckanRelation) matchesVersion(e repoEntry) bool {
+	switch {
+	case r.Version != "":
+		return compareVersions(e.version, r.Version) == 0
+	case r.MinVersion != "" && compareVersions(e.version, r.MinVersion) < 0:
+		return false
+	case r.MaxVersion != "" && compareVersions(e.version, r.MaxVersion) > 0:
+		return false
+	}
+	return true
+}
+
+// loadCuration reads curation file, relative to workspace. It returns nil
+// when file is missing and not required.
+func loadCuration(name string, required bool) (*curation, error) {
+	data, err := ioutil.ReadFile(workspaceAbs(name))
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := &curation{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, jsonError(name, data, err)
+	}
+	errs := newConfigErrors(name, data)
+	for i, r := range c.Include {
+		if r.Name == "" && len(r.AnyOf) == 0 {
+			errs.add(fmt.Sprintf("include[%d]", i), "missing name")
+		}
+	}
+	if len(errs.list) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// subset returns curated ckans from pool together with their dependencies.
+// All versions matching curated entry are included; for dependencies newest
+// matching version is picked, unless one is already included. Unresolved
+// dependencies are returned as warnings.
+func (c *curation) subset(pool []repoEntry) ([]repoEntry, []string, error) {
+	// newest versions first
+	sorted := append([]repoEntry{}, pool...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareVersions(sorted[i].version, sorted[j].version) > 0
+	})
+	selected := make(map[string]bool)
+	var result, queue []repoEntry
+	add := func(e repoEntry) {
+		if !selected[e.name] {
+			selected[e.name] = true
+			result = append(result, e)
+			queue = append(queue, e)
+		}
+	}
+	// resolve finds ckans satisfying relation, included ones first
+	resolve := func(r ckanRelation) (repoEntry, bool) {
+		alternatives := r.AnyOf
+		if len(alternatives) == 0 {
+			alternatives = []ckanRelation{r}
+		}
+		for _, a := range alternatives {
+			for _, e := range result {
+				if a.matches(e) {
+					return e, true
+				}
+			}
+		}
+		for _, a := range alternatives {
+			for _, e := range sorted {
+				if a.matches(e) {
+					return e, true
+				}
+			}
+		}
+		return repoEntry{}, false
+	}
+
+	var missing []string
+	for _, r := range c.Include {
+		found := false
+		for _, e := range sorted {
+			if r.selects(e) {
+				add(e)
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, r.String())
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("Curated mods not found in repos: %s", strings.Join(missing, ", "))
+	}
+
+	var warnings []string
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		for _, d := range e.depends {
+			dep, found := resolve(d)
+			if !found {
+				warnings = append(warnings, fmt.Sprintf("%s %s depends on %s, which is not in repos", e.identifier, e.version, d))
+				continue
+			}
+			add(dep)
+		}
+	}
+	return result, warnings, nil
+}
+
+// compareVersions compares CKAN versions like "1:1.2.3-beta". Epochs are
+// compared first, then alternating non-digit and digit parts of the rest.
+func compareVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+	for restA != "" || restB != "" {
+		var strA, strB, numA, numB string
+		strA, restA = splitVersionPart(restA, false)
+		strB, restB = splitVersionPart(restB, false)
+		if c := compareVersionStrings(strA, strB); c != 0 {
+			return c
+		}
+		numA, restA = splitVersionPart(restA, true)
+		numB, restB = splitVersionPart(restB, true)
+		if c := compareVersionNumbers(numA, numB); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func splitEpoch(v string) (int, string) {
+	if i := strings.IndexByte(v, ':'); i > 0 {
+		if epoch, err := strconv.Atoi(v[:i]); err == nil {
+			return epoch, v[i+1:]
+		}
+	}
+	return 0, v
+}
+
+// splitVersionPart splits leading digits, or leading non-digits, from v
+func splitVersionPart(v string, digits bool) (string, string) {
+	i := 0
+	for i < len(v) && (v[i] >= '0' && v[i] <= '9') == digits {
+		i++
+	}
+	return v[:i], v[i:]
+}
+
+// compareVersionStrings compares non-digit parts. Dot sorts before other
+// characters, so 1.0 < 1a0.
+func compareVersionStrings(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i] == '.' {
+			return -1
+		}
+		if b[i] == '.' {
+			return 1
+		}
+		if a[i] < b[i] {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func compareVersionNumbers(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// archiveNames lists files of tar.gz or zip archive. Missing archive has no
+// files.
+func archiveNames(path string) ([]string, error) {
+	if archiveFormat(path) == "zip" {
+		return zipNames(path)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeReg {
+			names = append(names, h.Name)
+		}
+	}
+	return names, nil
+}
+
+func zipNames(path string) ([]string, error) {
+	zr, err := zip.OpenReader(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// diffNames returns names added to and removed from old list
+func diffNames(old []string, entries []repoEntry) (added, removed []string) {
+	current := make(map[string]bool)
+	for _, e := range entries {
+		current[e.name] = true
+	}
+	previous := make(map[string]bool)
+	for _, n := range old {
+		previous[n] = true
+		if !current[n] {
+			removed = append(removed, n)
+		}
+	}
+	for _, e := range entries {
+		if !previous[e.name] {
+			added = append(added, e.name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// printArchiveDiff shows how new archive differs from one at path
+func printArchiveDiff(path string, entries []repoEntry) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	old, err := archiveNames(path)
+	if err != nil {
+		return errors.New("Could not read previous archive: " + err.Error())
+	}
+	added, removed := diffNames(old, entries)
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Println("No changes since previous archive")
+		return nil
+	}
+	Done("Changes since previous archive: %d added, %d removed\n", len(added), len(removed))
+	for _, n := range added {
+		fmt.Println("+ " + n)
+	}
+	for _, n := range removed {
+		fmt.Println("- " + n)
+	}
+	return nil
+}
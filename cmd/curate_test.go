@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.2", "1.10", -1},
+		{"1.0", "1.0.1", -1},
+		// epoch wins over everything else
+		{"1:0.1", "2.0", 1},
+		{"2.0", "1:0.1", -1},
+		{"1:1.0", "2:0.1", -1},
+		// dot sorts before other characters
+		{"1.0", "1a0", -1},
+		{"1a0", "1.0", 1},
+		{"1.0", "1.0-beta", -1},
+		{"v1.2", "v1.10", -1},
+		// leading zeros are ignored
+		{"1.01", "1.1", 0},
+		{"001", "1", 0},
+		{"1.010", "1.9", 1},
+		{"1.0", "1.00", 0},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRelationMatches(t *testing.T) {
+	mod := repoEntry{identifier: "Mod", version: "1.5"}
+	fork := repoEntry{identifier: "ModFork", version: "0.1", provides: []string{"Mod"}}
+	tests := []struct {
+		relation ckanRelation
+		entry    repoEntry
+		matches  bool
+		selects  bool
+	}{
+		{ckanRelation{Name: "Mod"}, mod, true, true},
+		{ckanRelation{Name: "Mod", Version: "1.5"}, mod, true, true},
+		{ckanRelation{Name: "Mod", Version: "1.4"}, mod, false, false},
+		{ckanRelation{Name: "Mod", MinVersion: "1.5"}, mod, true, true},
+		{ckanRelation{Name: "Mod", MinVersion: "1.6"}, mod, false, false},
+		{ckanRelation{Name: "Mod", MaxVersion: "1.4"}, mod, false, false},
+		{ckanRelation{Name: "Other"}, mod, false, false},
+		// providing mod satisfies dependency, but is not curated
+		{ckanRelation{Name: "Mod"}, fork, true, false},
+		// versions are not checked for providing mods
+		{ckanRelation{Name: "Mod", MinVersion: "1.0"}, fork, true, false},
+		{ckanRelation{AnyOf: []ckanRelation{{Name: "Other"}, {Name: "Mod"}}}, mod, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.relation.matches(tt.entry); got != tt.matches {
+			t.Errorf("%s matches %s = %v, want %v", tt.relation, tt.entry.identifier, got, tt.matches)
+		}
+		if got := tt.relation.selects(tt.entry); got != tt.selects {
+			t.Errorf("%s selects %s = %v, want %v", tt.relation, tt.entry.identifier, got, tt.selects)
+		}
+	}
+}
+
+func entry(identifier, version string, depends ...ckanRelation) repoEntry {
+	return repoEntry{name: identifier + "-" + version, identifier: identifier, version: version, depends: depends}
+}
+
+func entryNames(entries []repoEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCurationSubset(t *testing.T) {
+	provider := entry("Provider", "1.0")
+	provider.provides = []string{"Virtual"}
+	fork := entry("ModFork", "1.0")
+	fork.provides = []string{"Mod"}
+	pool := []repoEntry{
+		entry("Mod", "1.0", ckanRelation{Name: "Lib"}),
+		entry("Mod", "2.0", ckanRelation{Name: "Lib"}),
+		fork,
+		entry("Lib", "1.0"),
+		entry("Lib", "1.2", ckanRelation{Name: "Core"}),
+		entry("Lib", "0:1.10"),
+		entry("Core", "1.0"),
+		entry("AltA", "1.0"),
+		entry("AltB", "1.0"),
+		entry("Picky", "1.0", ckanRelation{AnyOf: []ckanRelation{{Name: "AltA"}, {Name: "AltB"}}}),
+		entry("Virt", "1.0", ckanRelation{Name: "Virtual"}),
+		provider,
+		entry("Broken", "1.0", ckanRelation{Name: "Gone"}),
+	}
+	tests := []struct {
+		name     string
+		include  []ckanRelation
+		want     []string
+		warnings int
+	}{
+		{
+			// all matching versions, newest matching dependency and its
+			// dependencies, fork providing Mod is left out
+			name:    "closure",
+			include: []ckanRelation{{Name: "Mod"}},
+			want:    []string{"Lib-0:1.10", "Mod-1.0", "Mod-2.0"},
+		},
+		{
+			name:    "version",
+			include: []ckanRelation{{Name: "Mod", MinVersion: "2.0"}, {Name: "Lib", Version: "1.2"}},
+			want:    []string{"Core-1.0", "Lib-1.2", "Mod-2.0"},
+		},
+		{
+			// included alternative wins over first listed one
+			name:    "any_of prefers included",
+			include: []ckanRelation{{Name: "Picky"}, {Name: "AltB"}},
+			want:    []string{"AltB-1.0", "Picky-1.0"},
+		},
+		{
+			name:    "any_of first alternative",
+			include: []ckanRelation{{Name: "Picky"}},
+			want:    []string{"AltA-1.0", "Picky-1.0"},
+		},
+		{
+			name:    "curated any_of",
+			include: []ckanRelation{{AnyOf: []ckanRelation{{Name: "Missing"}, {Name: "Core"}}}},
+			want:    []string{"Core-1.0"},
+		},
+		{
+			name:    "provides",
+			include: []ckanRelation{{Name: "Virt"}},
+			want:    []string{"Provider-1.0", "Virt-1.0"},
+		},
+		{
+			name:     "unresolved dependency",
+			include:  []ckanRelation{{Name: "Broken"}},
+			want:     []string{"Broken-1.0"},
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &curation{Include: tt.include}
+			result, warnings, err := c.subset(pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entryNames(result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subset is %v, want %v", got, tt.want)
+			}
+			if len(warnings) != tt.warnings {
+				t.Errorf("warnings %v, want %d", warnings, tt.warnings)
+			}
+		})
+	}
+
+	c := &curation{Include: []ckanRelation{{Name: "Virtual"}}}
+	if _, _, err := c.subset(pool); err == nil {
+		t.Error("curating mod only provided by other mods succeeded")
+	}
+}
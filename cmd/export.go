@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportOutput         string
+	exportFormat         string
+	exportOverlay        = false
+	exportDownloadCounts = false
+	exportChannel        string
+	exportBaseURL        string
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Pack your ckans into repository archive without starting server",
+	Long: `Writes the same repository as kure serve into single file that can be published to static
+	hosting or committed. Entries are sorted and have fixed timestamps and permissions, so the same
+	ckans always give the same archive. Format is guessed from --output name, tar.gz by default;
+	--format must match extension of --output when both are given.
+	--overlay, --download-counts, channels and curation.json work like in kure serve. First channel is
+	exported unless other is chosen with --channel. Ckans downloading from local/files need --base-url
+	of server hosting them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		ch, err := findChannel(exportChannel, exportOverlay)
+		if err != nil {
+			return err
+		}
+		format := exportFormat
+		if format == "" {
+			format = archiveFormat(exportOutput)
+		}
+		if !contains(archiveFormats, format) {
+			return fmt.Errorf("Unknown archive format %s, use one of: %s", format, strings.Join(archiveFormats, ", "))
+		}
+		// format of previous archive is known only from its name
+		if exportOutput != "" && archiveFormat(exportOutput) != format {
+			return fmt.Errorf("Output %s does not end with .%s, rename it or leave out --format", exportOutput, format)
+		}
+		output := exportOutput
+		if output == "" {
+			output = ch.Name + "." + format
+		}
+		output, err = filepath.Abs(output)
+		if err != nil {
+			return err
+		}
+		pack, err := repoEntries(ch, packOptions{downloadCounts: exportDownloadCounts, baseURL: exportBaseURL})
+		if err != nil {
+			return err
+		}
+		err = pack.report(output)
+		if err != nil {
+			return err
+		}
+		err = writeRepoArchive(pack.files(), output, format)
+		if err != nil {
+			return err
+		}
+		Done("Exported %d ckans to %s\n", len(pack.entries), output)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Archive path, channel name with format extension in current directory by default")
+	exportCmd.Flags().StringVar(&exportFormat, "format", "", "Archive format: tar.gz or zip")
+	exportCmd.Flags().BoolVar(&exportOverlay, "overlay", false, "Pack local ckans over downloaded ckan repos")
+	exportCmd.Flags().StringVar(&exportChannel, "channel", "", "Export channel from kure.json instead of first one")
+	exportCmd.Flags().StringVar(&exportBaseURL, "base-url", "", "URL where local/files are hosted under /files")
+	exportCmd.Flags().BoolVar(&exportDownloadCounts, "download-counts", false, "Pack download counts of packed mods from downloaded ckan repos")
+}
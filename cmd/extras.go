@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// upstreamFiles finds file with given name in downloaded ckan repos. It is
+// looked up in repo root and in top directory of unpacked archives, like
+// CKAN-meta-master.
+func upstreamFiles(name string) []string {
+	var paths []string
+	for _, repo := range conf.Repos {
+		if repo.Type != "ckan" {
+			continue
+		}
+		dir := workspacePath("cache", "repo", repo.Name)
+		candidates := []string{filepath.Join(dir, name)}
+		if nested, err := filepath.Glob(filepath.Join(dir, "*", name)); err == nil {
+			candidates = append(candidates, nested...)
+		}
+		for _, path := range candidates {
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				paths = append(paths, path)
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// upstreamBuilds returns builds.json of first downloaded ckan repo that has
+// one, nil if there is none
+func upstreamBuilds() (*repoEntry, error) {
+	paths := upstreamFiles("builds.json")
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s is not valid json", paths[0])
+	}
+	return &repoEntry{name: "builds.json", path: paths[0]}, nil
+}
+
+// downloadCountsEntry builds download_counts.json with upstream counts of
+// packed mods. Count from first repo that knows identifier wins.
+func downloadCountsEntry(entries []repoEntry) (repoEntry, error) {
+	packed := make(map[string]bool)
+	for _, e := range entries {
+		packed[e.identifier] = true
+	}
+	counts := make(map[string]int)
+	paths := upstreamFiles("download_counts.json")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return repoEntry{}, err
+		}
+		var upstream map[string]int
+		err = json.Unmarshal(data, &upstream)
+		if err != nil {
+			return repoEntry{}, fmt.Errorf("Could not read %s: %s", path, err)
+		}
+		for id, n := range upstream {
+			if _, found := counts[id]; !found && packed[id] {
+				counts[id] = n
+			}
+		}
+	}
+	if len(paths) == 0 {
+		Warn("No download_counts.json in downloaded ckan repos, download counts will be empty\n")
+	}
+	// map keys are sorted, so counts are packed in stable order
+	data, err := json.MarshalIndent(counts, "", "    ")
+	if err != nil {
+		return repoEntry{}, err
+	}
+	return repoEntry{name: "download_counts.json", data: data}, nil
+}
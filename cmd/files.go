@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// filesScheme starts download urls of archives hosted from local/files
+const filesScheme = "kure://"
+
+// hostedFile is archive from local/files with metadata written into ckans
+type hostedFile struct {
+	size   int64
+	sha1   string
+	sha256 string
+}
+
+// hostedName returns file name from local/files referenced by download url,
+// empty if url points elsewhere
+func hostedName(url string) string {
+	for _, prefix := range []string{filesScheme, conf.FilesPlaceholder} {
+		if prefix != "" && strings.HasPrefix(url, prefix) {
+			return strings.TrimPrefix(url, prefix)
+		}
+	}
+	return ""
+}
+
+// hostedFiles reads and hashes files from local/files, every file once
+type hostedFiles map[string]hostedFile
+
+func (h hostedFiles) get(name string) (hostedFile, error) {
+	if f, found := h[name]; found {
+		return f, nil
+	}
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || clean != name {
+		return hostedFile{}, fmt.Errorf("Invalid hosted file name `%s`", name)
+	}
+	file, err := os.Open(workspacePath("local", "files", filepath.FromSlash(name)))
+	if err != nil {
+		return hostedFile{}, err
+	}
+	defer file.Close()
+	s1 := sha1.New()
+	s256 := sha256.New()
+	size, err := io.Copy(io.MultiWriter(s1, s256), file)
+	if err != nil {
+		return hostedFile{}, err
+	}
+	f := hostedFile{
+		size:   size,
+		sha1:   strings.ToUpper(hex.EncodeToString(s1.Sum(nil))),
+		sha256: strings.ToUpper(hex.EncodeToString(s256.Sum(nil))),
+	}
+	h[name] = f
+	return f, nil
+}
+
+// rewriteDownloads points downloads of hosted files to filesURL, fills
+// download_size and download_hash in. Only rewritten keys of ckan change.
+func rewriteDownloads(entries []repoEntry, filesURL string) error {
+	files := make(hostedFiles)
+	for i, e := range entries {
+		var hosted []string
+		urls := make([]string, len(e.downloads))
+		for j, u := range e.downloads {
+			urls[j] = u
+			if name := hostedName(u); name != "" {
+				hosted = append(hosted, name)
+				urls[j] = strings.TrimRight(filesURL, "/") + "/files/" + name
+			}
+		}
+		if len(hosted) == 0 {
+			continue
+		}
+		if filesURL == "" {
+			return fmt.Errorf("%s downloads from local/files, set --base-url of server hosting them", e.name)
+		}
+		if len(hosted) < len(urls) {
+			return fmt.Errorf("%s mixes local/files and other downloads, which can't share download_hash", e.name)
+		}
+		f, err := files.get(hosted[0])
+		if err != nil {
+			return fmt.Errorf("%s: %s", e.name, err)
+		}
+		for _, name := range hosted[1:] {
+			other, err := files.get(name)
+			if err != nil {
+				return fmt.Errorf("%s: %s", e.name, err)
+			}
+			if other != f {
+				return fmt.Errorf("%s downloads different files %s and %s", e.name, hosted[0], name)
+			}
+		}
+		data, err := ioutil.ReadFile(e.path)
+		if err != nil {
+			return err
+		}
+		var download interface{} = urls[0]
+		if len(urls) > 1 {
+			download = urls
+		}
+		data, err = setJSONKey(data, "download", download)
+		if err == nil {
+			data, err = setJSONKey(data, "download_size", f.size)
+		}
+		if err == nil {
+			data, err = setJSONKey(data, "download_hash", map[string]string{"sha1": f.sha1, "sha256": f.sha256})
+		}
+		if err != nil {
+			return fmt.Errorf("Could not rewrite %s: %s", e.path, err)
+		}
+		entries[i].data = data
+	}
+	return nil
+}
@@ -46,6 +46,13 @@ var getCmd = &cobra.Command{
 		if c := checkWorkspace(); c != nil {
 			return c
 		}
+		mode := exclusiveLock
+		if getShow {
+			mode = sharedLock
+		}
+		if c := lockWorkspace(mode); c != nil {
+			return c
+		}
 		//get default extension for search if -i flag not set.
 		if includeExtensions == nil {
 			includeExtensions = append(includeExtensions, "netkan")
@@ -94,11 +101,7 @@ var getCmd = &cobra.Command{
 			} else { // show all found
 				n := color.New(color.Bold).SprintfFunc()
 				name := color.New(color.FgHiBlue).SprintfFunc()
-				pwdc, err := os.Getwd()
-				if err != nil {
-					return err
-				}
-				pwdc = filepath.Join(pwdc, "cache", "repo")
+				pwdc := workspacePath("cache", "repo")
 				// result to display
 				var result []string
 				for i, e := range files {
@@ -142,10 +145,7 @@ var getCmd = &cobra.Command{
 		}
 
 		//copy
-		pwd, err := os.Getwd()
-		if err != nil {
-			return err
-		}
+		pwd := workspaceDir
 
 		if isNetkan {
 			path := filepath.Join(pwd, "local", "netkan", filepath.Base(selectedPath))
@@ -162,7 +162,7 @@ var getCmd = &cobra.Command{
 				Warn("Package %s is reference to remote package.\nURL: %s\n", filepath.Base(selectedPath), url)
 				downloadIt := prompter.YN("Download it instead of copying package from cache?", true)
 				if downloadIt {
-					err = downloadFile(url, path, false)
+					err = downloadFile(url, path, false, nil)
 					return err
 				}
 			}
@@ -195,14 +195,12 @@ func init() {
 
 // get files with given extension and id.
 func getFiles(id string, extensions []string, method searchMethod) ([]string, error) {
-	pwd, err := os.Getwd()
-	if err != nil {
-		return nil, err
-	}
-
 	var result []string
-	err = filepath.Walk(filepath.Join(pwd, "cache", "repo"),
+	err := filepath.Walk(workspacePath("cache", "repo"),
 		func(path string, f os.FileInfo, err error) error {
+			if f.IsDir() && f.Name() == ".git" {
+				return filepath.SkipDir
+			}
 			// get extension
 			ext := filepath.Ext(path)
 			if !f.IsDir() && contains(extensions, strings.TrimPrefix(ext, ".")) {
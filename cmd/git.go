@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ungerik/go-dry"
+)
+
+// gitSource is git repository. It's cloned once and fetched on later updates.
+type gitSource struct {
+	urls []string
+	used string
+	// branch, tag or commit. Remote HEAD when empty.
+	ref  string
+	auth *repoAuth
+}
+
+func (s *gitSource) fetch(dest string) (snapshot, error) {
+	snap, err := s.fetchObjects(dest)
+	if err != nil {
+		return snapshot{}, err
+	}
+	return snap, s.checkout(dest, snap.Commit)
+}
+
+func (s *gitSource) restore(dest string, snap snapshot) error {
+	err := s.restoreObjects(dest, snap)
+	if err != nil {
+		return err
+	}
+	return s.checkout(dest, snap.Commit)
+}
+
+// fetchObjects is fetch that leaves working tree of existing clone as it
+// was. Resolved commit is checked out later with checkout.
+func (s *gitSource) fetchObjects(dest string) (snapshot, error) {
+	err := s.sync(dest)
+	if err != nil {
+		return snapshot{}, err
+	}
+	commit, err := s.resolve(dest)
+	if err != nil {
+		return snapshot{}, err
+	}
+	return snapshot{Commit: commit}, nil
+}
+
+// restoreObjects makes sure commit of snapshot is in clone, without checking
+// it out
+func (s *gitSource) restoreObjects(dest string, snap snapshot) error {
+	err := s.sync(dest)
+	if err != nil {
+		return err
+	}
+	_, err = git(dest, "cat-file", "-e", snap.Commit+"^{commit}")
+	if err != nil {
+		// commits not reachable from any branch have to be fetched explicitly
+		_, err = s.remote(dest, s.used, "fetch", "--quiet", "origin", snap.Commit)
+		if err != nil {
+			return fmt.Errorf("Commit %s of %s is no longer available", snap.Commit, redactURL(s.urls[0]))
+		}
+	}
+	return nil
+}
+
+// sync clones repository or fetches it if clone already exists
+func (s *gitSource) sync(dest string) error {
+	var err error
+	if dry.FileIsDir(filepath.Join(dest, ".git")) {
+		s.used, err = tryURLs(s.urls, func(url string) error {
+			_, err := git(dest, "remote", "set-url", "origin", url)
+			if err != nil {
+				return err
+			}
+			_, err = s.remote(dest, url, "fetch", "--quiet", "--tags", "--force", "--prune", "origin")
+			return err
+		})
+		return err
+	}
+	s.used, err = tryURLs(s.urls, func(url string) error {
+		// leftover from other source kind or failed clone
+		err := os.RemoveAll(dest)
+		if err != nil {
+			return err
+		}
+		_, err = s.remote("", url, "clone", "--quiet", "--no-checkout", url, dest)
+		return err
+	})
+	return err
+}
+
+func (s *gitSource) origin() string {
+	return s.used
+}
+
+func (s *gitSource) checkout(dest, commit string) error {
+	_, err := git(dest, "checkout", "--quiet", "--force", "--detach", commit)
+	return err
+}
+
+// resolve finds commit pointed by ref. Branches are looked up on remote first
+// so local checkout never lags behind.
+func (s *gitSource) resolve(dir string) (string, error) {
+	if s.ref == "" {
+		return git(dir, "rev-parse", "--verify", "refs/remotes/origin/HEAD^{commit}")
+	}
+	for _, r := range []string{"refs/remotes/origin/" + s.ref, "refs/tags/" + s.ref, s.ref} {
+		if commit, err := git(dir, "rev-parse", "--verify", "--quiet", r+"^{commit}"); err == nil {
+			return commit, nil
+		}
+	}
+	// commits not reachable from any branch have to be fetched explicitly
+	_, err := s.remote(dir, s.used, "fetch", "--quiet", "origin", s.ref)
+	if err != nil {
+		return "", fmt.Errorf("Could not find `%s` in %s", s.ref, redactURL(s.used))
+	}
+	return git(dir, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+}
+
+// remote runs git command that talks to remote at url, with credentials
+// if repo has them. Credentials are passed in environment, so they don't
+// show up in process list or verbose output.
+func (s *gitSource) remote(dir, url string, args ...string) (string, error) {
+	header, err := s.auth.header(url)
+	if err != nil {
+		return "", err
+	}
+	var env []string
+	if header != "" {
+		env = []string{
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http." + url + ".extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: " + header,
+		}
+	}
+	return gitEnv(dir, env, args...)
+}
+
+// git runs git command in dir and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	return gitEnv(dir, nil, args...)
+}
+
+// gitEnv runs git command with additional environment variables
+func gitEnv(dir string, env []string, args ...string) (string, error) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(gitBin, args...)
+	cmd.Dir = dir
+	// never wait for password on terminal
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if verbose {
+		var printed []string
+		for _, a := range args {
+			printed = append(printed, redactURL(a))
+		}
+		fmt.Printf("git %s\n", strings.Join(printed, " "))
+	}
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
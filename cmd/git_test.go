@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitFixture is bare repository with working clone used to push commits
+type gitFixture struct {
+	t    *testing.T
+	bare string
+	work string
+}
+
+func newGitFixture(t *testing.T) *gitFixture {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	f := &gitFixture{t: t, bare: filepath.Join(dir, "remote.git"), work: filepath.Join(dir, "work")}
+	f.run(dir, "init", "--quiet", "--bare", "--initial-branch=main", f.bare)
+	// commits of deleted branches can still be fetched by sha
+	f.run(f.bare, "config", "uploadpack.allowAnySHA1InWant", "true")
+	f.run(dir, "clone", "--quiet", f.bare, f.work)
+	f.run(f.work, "checkout", "--quiet", "-b", "main")
+	return f
+}
+
+func (f *gitFixture) run(dir string, args ...string) string {
+	f.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=kure", "GIT_AUTHOR_EMAIL=kure@example.com",
+		"GIT_COMMITTER_NAME=kure", "GIT_COMMITTER_EMAIL=kure@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		f.t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes content into file.txt, commits it and returns its sha
+func (f *gitFixture) commit(content string) string {
+	f.t.Helper()
+	err := ioutil.WriteFile(filepath.Join(f.work, "file.txt"), []byte(content), 0644)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.run(f.work, "add", "file.txt")
+	f.run(f.work, "commit", "--quiet", "-m", content)
+	return f.run(f.work, "rev-parse", "HEAD")
+}
+
+func (f *gitFixture) push(refs ...string) {
+	f.t.Helper()
+	f.run(f.work, append([]string{"push", "--quiet", "--force", "origin"}, refs...)...)
+}
+
+func (f *gitFixture) source(ref string) *gitSource {
+	return &gitSource{urls: []string{f.bare}, ref: ref}
+}
+
+func checkContent(t *testing.T, dest, want string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dest, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("file.txt is %q, want %q", data, want)
+	}
+}
+
+func TestGitSourceFetchesHead(t *testing.T) {
+	f := newGitFixture(t)
+	first := f.commit("first")
+	f.push("main")
+	f.run(f.bare, "symbolic-ref", "HEAD", "refs/heads/main")
+	dest := filepath.Join(t.TempDir(), "repo")
+
+	snap, err := f.source("").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Commit != first {
+		t.Errorf("fetched %s, want %s", snap.Commit, first)
+	}
+	checkContent(t, dest, "first")
+
+	second := f.commit("second")
+	f.push("main")
+	snap, err = f.source("").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Commit != second {
+		t.Errorf("re-fetched %s, want %s", snap.Commit, second)
+	}
+	checkContent(t, dest, "second")
+}
+
+func TestGitSourcePins(t *testing.T) {
+	f := newGitFixture(t)
+	tagged := f.commit("tagged")
+	f.run(f.work, "tag", "v1")
+	f.push("main", "v1")
+	f.run(f.work, "checkout", "--quiet", "-b", "dev")
+	dev := f.commit("dev")
+	f.push("dev")
+	f.run(f.work, "checkout", "--quiet", "main")
+	head := f.commit("main")
+	f.push("main")
+	// commit of deleted branch is not fetched by clone
+	f.run(f.work, "checkout", "--quiet", "-b", "gone")
+	gone := f.commit("gone")
+	f.push("gone")
+	f.push(":gone")
+
+	tests := []struct {
+		ref     string
+		commit  string
+		content string
+	}{
+		{"main", head, "main"},
+		{"dev", dev, "dev"},
+		{"v1", tagged, "tagged"},
+		{tagged, tagged, "tagged"},
+		{gone, gone, "gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content+"/"+tt.ref, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "repo")
+			snap, err := f.source(tt.ref).fetch(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snap.Commit != tt.commit {
+				t.Errorf("fetched %s, want %s", snap.Commit, tt.commit)
+			}
+			checkContent(t, dest, tt.content)
+		})
+	}
+
+	_, err := f.source("missing").fetch(filepath.Join(t.TempDir(), "repo"))
+	if err == nil {
+		t.Error("fetching missing ref succeeded")
+	}
+}
+
+func TestGitSourceBranchPinFollowsPush(t *testing.T) {
+	f := newGitFixture(t)
+	f.commit("first")
+	f.push("main")
+	dest := filepath.Join(t.TempDir(), "repo")
+	_, err := f.source("main").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := f.commit("second")
+	f.push("main")
+	snap, err := f.source("main").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Commit != second {
+		t.Errorf("fetched %s, want %s", snap.Commit, second)
+	}
+	checkContent(t, dest, "second")
+}
+
+func TestGitSourceRestore(t *testing.T) {
+	f := newGitFixture(t)
+	first := f.commit("first")
+	f.push("main")
+	dest := filepath.Join(t.TempDir(), "repo")
+	snap, err := f.source("main").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.commit("second")
+	f.push("main")
+	_, err = f.source("main").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// existing clone and fresh one restore the same commit
+	for _, d := range []string{dest, filepath.Join(t.TempDir(), "fresh")} {
+		err = f.source("main").restore(d, snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commit := f.run(d, "rev-parse", "HEAD"); commit != first {
+			t.Errorf("restored %s, want %s", commit, first)
+		}
+		checkContent(t, d, "first")
+	}
+
+	// commit no longer on any branch is fetched by sha
+	f.run(f.work, "reset", "--quiet", "--hard", first)
+	f.push("main")
+	second := snapshot{Commit: f.run(f.work, "rev-parse", "HEAD@{1}")}
+	late := filepath.Join(t.TempDir(), "late")
+	err = f.source("main").restore(late, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, late, "second")
+
+	err = f.source("main").restore(dest, snapshot{Commit: strings.Repeat("0", 40)})
+	if err == nil {
+		t.Error("restoring unknown commit succeeded")
+	}
+}
+
+func TestGitSourceFetchObjectsKeepsCheckout(t *testing.T) {
+	f := newGitFixture(t)
+	first := f.commit("first")
+	f.push("main")
+	dest := filepath.Join(t.TempDir(), "repo")
+	_, err := f.source("main").fetch(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := f.commit("second")
+	f.push("main")
+
+	snap, err := f.source("main").fetchObjects(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Commit != second {
+		t.Errorf("resolved %s, want %s", snap.Commit, second)
+	}
+	checkContent(t, dest, "first")
+	err = f.source("main").restoreObjects(dest, snapshot{Commit: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "first")
+
+	err = f.source("main").checkout(dest, snap.Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, "second")
+}
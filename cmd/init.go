@@ -30,6 +30,9 @@ var initCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		if workspaceFlag != "" {
+			pwd = workspaceDir
+		}
 
 		//create directory
 		path := filepath.Join(pwd, args[0])
@@ -46,6 +49,7 @@ var initCmd = &cobra.Command{
 		os.Mkdir(filepath.Join(path, "local"), DirPerm)
 		os.MkdirAll(filepath.Join(path, "local", "netkan"), DirPerm)
 		os.MkdirAll(filepath.Join(path, "local", "ckan"), DirPerm)
+		os.MkdirAll(filepath.Join(path, "local", "files"), DirPerm)
 		//cache
 		os.MkdirAll(filepath.Join(path, "cache", "repo"), DirPerm)
 		os.MkdirAll(filepath.Join(path, "cache", "server"), DirPerm)
@@ -55,6 +59,7 @@ var initCmd = &cobra.Command{
 		//default config
 		dry.FileAppendString(filepath.Join(path, "kure.json"), `
 {
+    "config_version": 1,
     "netkan_exe": "https://ckan-travis.s3.amazonaws.com/netkan.exe",
     "cachedir" : "./cache/download/",
     "repos": [
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonMember is key of object or element of array, located by byte offsets
+type jsonMember struct {
+	// empty for array elements
+	key string
+	// offset of key, or of value for array elements
+	keyStart int
+	start    int
+	end      int
+}
+
+// setJSONKey sets top level key of json object in data, see setJSONPath
+func setJSONKey(data []byte, key string, value interface{}) ([]byte, error) {
+	return setJSONPath(data, []string{key}, value)
+}
+
+// setJSONPath sets value at path of keys and array indexes. Only bytes of the
+// value are replaced, so rest of file keeps its formatting. Missing keys are
+// appended at the end of their object, together with missing parent objects.
+func setJSONPath(data []byte, path []string, value interface{}) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, errors.New("Empty json path")
+	}
+	indent := jsonIndent(data)
+	start := skipJSONSeparators(data, 0)
+	for depth, key := range path {
+		open, members, closing, err := jsonChildren(data, start)
+		if err != nil {
+			return nil, err
+		}
+		m, found, err := findJSONMember(open, members, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", formatConfigPath(path[:depth+1]), err)
+		}
+		if !found {
+			for i := len(path) - 1; i > depth; i-- {
+				value = map[string]interface{}{path[i]: value}
+			}
+			return insertJSONMember(data, members, closing, key, value, indent, depth+1)
+		}
+		if depth == len(path)-1 {
+			encoded, err := json.MarshalIndent(value, strings.Repeat(indent, depth+1), indent)
+			if err != nil {
+				return nil, err
+			}
+			return splice(data, m.start, m.end, encoded), nil
+		}
+		start = m.start
+	}
+	panic("unreachable")
+}
+
+// deleteJSONPath removes key or array element at path, together with its
+// separator. It reports whether anything was removed.
+func deleteJSONPath(data []byte, path []string) ([]byte, bool, error) {
+	if len(path) == 0 {
+		return nil, false, errors.New("Empty json path")
+	}
+	start := skipJSONSeparators(data, 0)
+	for depth, key := range path {
+		open, members, closing, err := jsonChildren(data, start)
+		if err != nil {
+			return nil, false, err
+		}
+		m, found, err := findJSONMember(open, members, key)
+		if err != nil || !found {
+			return data, false, nil
+		}
+		if depth < len(path)-1 {
+			start = m.start
+			continue
+		}
+		i := 0
+		for members[i] != m {
+			i++
+		}
+		switch {
+		case i > 0:
+			// comma after previous member up to end of this one
+			return splice(data, members[i-1].end, m.end, nil), true, nil
+		case len(members) > 1:
+			return splice(data, m.keyStart, members[1].keyStart, nil), true, nil
+		default:
+			return splice(data, start+1, closing, nil), true, nil
+		}
+	}
+	panic("unreachable")
+}
+
+// jsonChildren lists members of object or array starting at data[start]
+func jsonChildren(data []byte, start int) (open byte, members []jsonMember, closing int, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data[start:]))
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok || (delim != '{' && delim != '[') {
+		return 0, nil, 0, errors.New("not an object or array")
+	}
+	for dec.More() {
+		m := jsonMember{keyStart: skipJSONSeparators(data, start+int(dec.InputOffset()))}
+		if delim == '{' {
+			tok, err = dec.Token()
+			if err != nil {
+				return 0, nil, 0, err
+			}
+			m.key = fmt.Sprint(tok)
+		}
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		m.end = start + int(dec.InputOffset())
+		m.start = m.end - len(raw)
+		members = append(members, m)
+	}
+	_, err = dec.Token()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return byte(delim), members, start + int(dec.InputOffset()) - 1, nil
+}
+
+// findJSONMember looks key up in object, or index in array
+func findJSONMember(open byte, members []jsonMember, key string) (jsonMember, bool, error) {
+	if open == '[' {
+		i, err := strconv.Atoi(key)
+		if err != nil {
+			return jsonMember{}, false, errors.New("array index must be a number")
+		}
+		if i < 0 || i >= len(members) {
+			return jsonMember{}, false, fmt.Errorf("index out of range, array has %d elements", len(members))
+		}
+		return members[i], true, nil
+	}
+	for _, m := range members {
+		if m.key == key {
+			return m, true, nil
+		}
+	}
+	return jsonMember{}, false, nil
+}
+
+// insertJSONMember appends key to object closed at data[closing]. Depth is
+// nesting level of new member, used for indentation.
+func insertJSONMember(data []byte, members []jsonMember, closing int, key string, value interface{}, indent string, depth int) ([]byte, error) {
+	if data[closing] != '}' {
+		return nil, errors.New("Can't add elements to array")
+	}
+	encoded, err := json.MarshalIndent(value, strings.Repeat(indent, depth), indent)
+	if err != nil {
+		return nil, err
+	}
+	name, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	// end of last value, before whitespace
+	last := len(bytes.TrimRight(data[:closing], " \t\r\n"))
+	entry := "\n" + strings.Repeat(indent, depth) + string(name) + ": " + string(encoded) + "\n" + strings.Repeat(indent, depth-1)
+	if len(members) > 0 {
+		entry = "," + entry
+	}
+	return splice(data, last, closing, []byte(entry)), nil
+}
+
+// jsonIndent guesses indentation unit used in data. Defaults to 4 spaces.
+func jsonIndent(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) && strings.HasPrefix(trimmed, `"`) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "    "
+}
+
+// skipJSONSeparators moves offset past whitespace, colons and commas
+func skipJSONSeparators(data []byte, offset int) int {
+	for offset < len(data) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func splice(data []byte, start, end int, value []byte) []byte {
+	result := make([]byte, 0, len(data)-(end-start)+len(value))
+	result = append(result, data[:start]...)
+	result = append(result, value...)
+	return append(result, data[end:]...)
+}
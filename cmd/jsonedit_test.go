@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSetJSONPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		path  []string
+		value interface{}
+		want  string
+	}{
+		{
+			name:  "empty object",
+			data:  "{}",
+			path:  []string{"netkan_exe"},
+			value: "x",
+			want:  "{\n    \"netkan_exe\": \"x\"\n}",
+		},
+		{
+			name:  "empty object with newline",
+			data:  "{\n}\n",
+			path:  []string{"netkan_exe"},
+			value: "x",
+			want:  "{\n    \"netkan_exe\": \"x\"\n}\n",
+		},
+		{
+			name:  "replace value only",
+			data:  "{\n  \"a\":   1, \"b\": 2\n}",
+			path:  []string{"a"},
+			value: 3,
+			want:  "{\n  \"a\":   3, \"b\": 2\n}",
+		},
+		{
+			name:  "append keeps two space indent",
+			data:  "{\n  \"a\": 1\n}\n",
+			path:  []string{"b"},
+			value: true,
+			want:  "{\n  \"a\": 1,\n  \"b\": true\n}\n",
+		},
+		{
+			name:  "append keeps tab indent",
+			data:  "{\n\t\"a\": 1\n}",
+			path:  []string{"b"},
+			value: []string{"x"},
+			want:  "{\n\t\"a\": 1,\n\t\"b\": [\n\t\t\"x\"\n\t]\n}",
+		},
+		{
+			name:  "nested object",
+			data:  "{\n    \"repos\": [\n        {\n            \"name\": \"meta\"\n        }\n    ]\n}",
+			path:  []string{"repos", "0", "url"},
+			value: "https://example.com",
+			want:  "{\n    \"repos\": [\n        {\n            \"name\": \"meta\",\n            \"url\": \"https://example.com\"\n        }\n    ]\n}",
+		},
+		{
+			name:  "missing parent object",
+			data:  "{\n    \"a\": 1\n}",
+			path:  []string{"serve_auth", "type"},
+			value: "basic",
+			want:  "{\n    \"a\": 1,\n    \"serve_auth\": {\n        \"type\": \"basic\"\n    }\n}",
+		},
+		{
+			name:  "empty nested object",
+			data:  "{\n    \"serve_auth\": {}\n}",
+			path:  []string{"serve_auth", "type"},
+			value: "basic",
+			want:  "{\n    \"serve_auth\": {\n        \"type\": \"basic\"\n    }\n}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setJSONPath([]byte(tt.data), tt.path, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("result is not valid json:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestSetJSONPathErrors(t *testing.T) {
+	data := []byte(`{"repos": [{"name": "a"}]}`)
+	for _, path := range [][]string{{}, {"repos", "x"}, {"repos", "1", "name"}, {"repos", "1"}} {
+		if _, err := setJSONPath(data, path, "v"); err == nil {
+			t.Errorf("setting %v succeeded", path)
+		}
+	}
+}
+
+func TestDeleteJSONPath(t *testing.T) {
+	object := "{\n    \"a\": 1,\n    \"b\": 2,\n    \"c\": 3\n}"
+	array := "{\"list\": [1, 2, 3]}"
+	tests := []struct {
+		name    string
+		data    string
+		path    []string
+		want    string
+		removed bool
+	}{
+		{"first", object, []string{"a"}, "{\n    \"b\": 2,\n    \"c\": 3\n}", true},
+		{"middle", object, []string{"b"}, "{\n    \"a\": 1,\n    \"c\": 3\n}", true},
+		{"last", object, []string{"c"}, "{\n    \"a\": 1,\n    \"b\": 2\n}", true},
+		{"only", "{\n    \"a\": 1\n}", []string{"a"}, "{}", true},
+		{"first element", array, []string{"list", "0"}, "{\"list\": [2, 3]}", true},
+		{"middle element", array, []string{"list", "1"}, "{\"list\": [1, 3]}", true},
+		{"last element", array, []string{"list", "2"}, "{\"list\": [1, 2]}", true},
+		{"only element", "{\"list\": [1]}", []string{"list", "0"}, "{\"list\": []}", true},
+		{
+			"nested",
+			"{\n    \"serve_auth\": {\n        \"type\": \"basic\",\n        \"username_env\": \"U\"\n    }\n}",
+			[]string{"serve_auth", "username_env"},
+			"{\n    \"serve_auth\": {\n        \"type\": \"basic\"\n    }\n}",
+			true,
+		},
+		{"missing", object, []string{"d"}, object, false},
+		{"missing parent", object, []string{"d", "e"}, object, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed, err := deleteJSONPath([]byte(tt.data), tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != tt.removed {
+				t.Errorf("removed = %v, want %v", removed, tt.removed)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("result is not valid json:\n%s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockMode tells if command changes workspace or only reads it
+type lockMode int
+
+const (
+	sharedLock lockMode = iota
+	exclusiveLock
+)
+
+// errLocked is returned by flock when other process holds the lock
+var errLocked = errors.New("workspace is locked")
+
+var (
+	// waitLock makes commands wait for busy workspace instead of failing
+	waitLock = false
+	// heldLock is lock taken by lockWorkspace, released by Execute
+	heldLock *workspaceLock
+)
+
+// workspaceLock is advisory lock of cache/workspace.lock. Exclusive holder
+// writes lockHolder into the file and truncates it when done, so holder that
+// died in the middle of work can be detected.
+type workspaceLock struct {
+	file *os.File
+	mode lockMode
+}
+
+// lockHolder describes process holding exclusive lock
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+func (h *lockHolder) String() string {
+	return fmt.Sprintf("`%s` (pid %d, started %s)", h.Command, h.PID, h.Started.Format("2006-01-02 15:04:05"))
+}
+
+// lockWorkspace takes workspace lock for rest of the run. Commands changing
+// cache, local files or config take exclusive lock, readers take shared one.
+// Config migrated by loadConfig is saved once exclusive lock is held.
+func lockWorkspace(mode lockMode) error {
+	if heldLock != nil {
+		if mode == exclusiveLock && heldLock.mode != exclusiveLock {
+			return errors.New("Workspace is locked for reading only, it can't be changed")
+		}
+		return nil
+	}
+	path := workspacePath("cache", "workspace.lock")
+	err := os.MkdirAll(filepath.Dir(path), DirPerm)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	exclusive := mode == exclusiveLock
+	err = flock(f, exclusive, false)
+	if err == errLocked {
+		holder := "other kure command"
+		if h := readLockHolder(f); h != nil && processAlive(h.PID) {
+			holder = h.String()
+		}
+		if !waitLock {
+			f.Close()
+			return fmt.Errorf("Workspace is in use by %s. Run with --wait to wait until it finishes", holder)
+		}
+		Warn("Waiting for %s to finish\n", holder)
+		err = flock(f, exclusive, true)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if exclusive {
+		// lock is free, so recorded holder died without releasing it
+		if h := readLockHolder(f); h != nil {
+			Warn("Lock file was left by %s, which is no longer running.\n", h)
+			fmt.Println("It was interrupted and workspace may be inconsistent, run it again.")
+		}
+		err = writeLockHolder(f)
+		if err != nil {
+			funlock(f)
+			f.Close()
+			return err
+		}
+	}
+	heldLock = &workspaceLock{file: f, mode: mode}
+	return saveMigratedConfig(mode)
+}
+
+// releaseWorkspace releases lock taken by lockWorkspace, if any
+func releaseWorkspace() {
+	if heldLock == nil {
+		return
+	}
+	if heldLock.mode == exclusiveLock {
+		heldLock.file.Truncate(0)
+	}
+	funlock(heldLock.file)
+	heldLock.file.Close()
+	heldLock = nil
+}
+
+// readLockHolder returns holder recorded in lock file, nil if there is none
+func readLockHolder(f *os.File) *lockHolder {
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	h := &lockHolder{}
+	if json.Unmarshal(data, h) != nil {
+		return nil
+	}
+	return h
+}
+
+func writeLockHolder(f *os.File) error {
+	args := append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...)
+	data, err := json.Marshal(lockHolder{
+		PID:     os.Getpid(),
+		Command: strings.Join(args, " "),
+		Started: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import "testing"
+
+func TestLockWorkspaceRefusesUpgrade(t *testing.T) {
+	old := workspaceDir
+	workspaceDir = t.TempDir()
+	t.Cleanup(func() {
+		releaseWorkspace()
+		workspaceDir = old
+	})
+	if err := lockWorkspace(sharedLock); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockWorkspace(sharedLock); err != nil {
+		t.Errorf("taking held shared lock again failed: %s", err)
+	}
+	if err := lockWorkspace(exclusiveLock); err == nil {
+		t.Error("shared lock was taken as exclusive")
+	}
+	releaseWorkspace()
+	if err := lockWorkspace(exclusiveLock); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockWorkspace(sharedLock); err != nil {
+		t.Errorf("exclusive lock does not cover shared one: %s", err)
+	}
+}
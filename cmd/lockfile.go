@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// lockFile records exact snapshots of repos fetched by last `kure update`.
+// It's kept in kure.lock next to kure.json, so it can be shared with others.
+type lockFile struct {
+	Repos []lockedRepo `json:"repos"`
+}
+
+type lockedRepo struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Source string `json:"source,omitempty"`
+	URL    string `json:"url"`
+	snapshot
+	Fetched time.Time `json:"fetched"`
+}
+
+func lockFilePath() string {
+	return workspacePath("kure.lock")
+}
+
+func loadLockFile() (*lockFile, error) {
+	data, err := ioutil.ReadFile(lockFilePath())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("There is no kure.lock in workspace, run `kure update` first")
+	} else if err != nil {
+		return nil, err
+	}
+	lock := &lockFile{}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read kure.lock: %s", err)
+	}
+	return lock, nil
+}
+
+func (l *lockFile) save() error {
+	path := lockFilePath()
+	data, err := json.MarshalIndent(l, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// find returns locked snapshot of repo. Repo must be locked with the same
+// url and source, otherwise lock is out of date.
+func (l *lockFile) find(repo repoConfig) (lockedRepo, error) {
+	for _, r := range l.Repos {
+		if r.Name != repo.Name {
+			continue
+		}
+		if r.URL != repo.URL || r.Source != repo.Source {
+			return r, fmt.Errorf("Repo `%s` changed since kure.lock was written, run `kure update` without --locked", repo.Name)
+		}
+		return r, nil
+	}
+	return lockedRepo{}, fmt.Errorf("Repo `%s` is not in kure.lock, run `kure update` without --locked", repo.Name)
+}
+
+func (l *lockFile) add(repo repoConfig, snap snapshot, fetched time.Time) {
+	l.Repos = append(l.Repos, lockedRepo{
+		Name:     repo.Name,
+		Type:     repo.Type,
+		Source:   repo.Source,
+		URL:      repo.URL,
+		snapshot: snap,
+		Fetched:  fetched,
+	})
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mirrorURLs returns urls to try, in order, when downloading from url.
+// Urls matching mirror_rewrite rules are rewritten first and original url
+// is used only when rewritten one fails.
+func mirrorURLs(url string, mirrors []string) []string {
+	var result []string
+	for _, u := range append([]string{url}, mirrors...) {
+		for _, candidate := range []string{rewriteURL(u), u} {
+			if !contains(result, candidate) {
+				result = append(result, candidate)
+			}
+		}
+	}
+	return result
+}
+
+// rewriteURL applies first matching mirror_rewrite rule from kure.json
+func rewriteURL(url string) string {
+	for _, rule := range conf.MirrorRewrite {
+		if strings.HasPrefix(url, rule.From) {
+			return rule.To + strings.TrimPrefix(url, rule.From)
+		}
+	}
+	return url
+}
+
+// tryURLs calls f with every url until it succeeds. Returns url that worked.
+func tryURLs(urls []string, f func(url string) error) (string, error) {
+	var err error
+	for i, url := range urls {
+		err = f(url)
+		if err == nil {
+			return url, nil
+		}
+		if i < len(urls)-1 {
+			Warn("Could not fetch %s: %s\n", redactURL(url), err)
+			fmt.Printf("Trying %s\n", redactURL(urls[i+1]))
+		}
+	}
+	return "", err
+}
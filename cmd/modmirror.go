@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	mirrorChannel string
+	mirrorOverlay = false
+)
+
+// mirrorCmd represents the mirror command
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "Download mod archives of channel for offline kure serve --mirror",
+	Long: `Downloads archives of all mods in channel into cache/mirror, where they are kept under their
+	sha256. Size and hash from ckan are verified, ckans without sha256 in download_hash are skipped.
+	Mirrored archives are served by kure serve --mirror, so clients can install mods without internet.
+	First channel is mirrored unless other is chosen with --channel, --overlay works like in kure serve.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
+		ch, err := findChannel(mirrorChannel, mirrorOverlay)
+		if err != nil {
+			return err
+		}
+		pack, err := packCkans(ch)
+		if err != nil {
+			return err
+		}
+		store := mirrorStore()
+		err = os.MkdirAll(store.dir, DirPerm)
+		if err != nil {
+			return err
+		}
+		var mirrored, present, skipped, failed int
+		for _, e := range pack.entries {
+			switch {
+			case len(e.downloads) == 0 || hostedName(e.downloads[0]) != "":
+				continue
+			case e.sha256 == "":
+				skipped++
+				if verbose {
+					Warn("Skipping %s, it has no sha256\n", e.name)
+				}
+				continue
+			case store.has(e.sha256):
+				present++
+				continue
+			}
+			Done("Mirroring %s %s\n", e.identifier, e.version)
+			err := mirrorEntry(store, e)
+			if err != nil {
+				Warn("Mirroring %s failed: %s\n", e.name, err)
+				failed++
+				continue
+			}
+			mirrored++
+		}
+		fmt.Printf("Mirrored %d archives, %d were already mirrored, %d ckans have no sha256\n", mirrored, present, skipped)
+		if failed > 0 {
+			return fmt.Errorf("%d archives failed to mirror", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mirrorCmd)
+	mirrorCmd.Flags().StringVar(&mirrorChannel, "channel", "", "Mirror channel from kure.json instead of first one")
+	mirrorCmd.Flags().BoolVarP(&mirrorOverlay, "overlay", "o", false, "Mirror local ckans over downloaded ckan repos")
+}
+
+// mirrorStore keeps mirrored mod archives of workspace under their sha256
+func mirrorStore() *blobStore {
+	return &blobStore{dir: workspacePath("cache", "mirror")}
+}
+
+// mirrorEntry downloads archive of ckan, trying its urls in order, and
+// adds it to store when size and hash match
+func mirrorEntry(store *blobStore, e repoEntry) error {
+	tmp, err := ioutil.TempFile(store.dir, ".download-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	_, err = tryURLs(mirrorURLs(e.downloads[0], e.downloads[1:]), func(url string) error {
+		err := downloadFile(url, tmp.Name(), false, nil)
+		if err != nil {
+			return err
+		}
+		if e.size > 0 {
+			info, err := os.Stat(tmp.Name())
+			if err != nil {
+				return err
+			}
+			if info.Size() != e.size {
+				return fmt.Errorf("download has %d bytes, ckan says %d", info.Size(), e.size)
+			}
+		}
+		sum, err := hashFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+		if sum != e.sha256 {
+			return fmt.Errorf("download has sha256 %s, ckan says %s", strings.ToUpper(sum), strings.ToUpper(e.sha256))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.path(e.sha256))
+}
+
+// rewriteMirrored puts /mirror of server at baseURL in front of downloads of
+// mirrored archives, original urls stay after it as fallbacks. Ckans of
+// archives that are not mirrored keep original urls only.
+func rewriteMirrored(entries []repoEntry, baseURL string) error {
+	store := mirrorStore()
+	for i, e := range entries {
+		if !store.has(e.sha256) || len(e.downloads) == 0 || hostedName(e.downloads[0]) != "" {
+			continue
+		}
+		data := e.data
+		if data == nil {
+			var err error
+			data, err = ioutil.ReadFile(e.path)
+			if err != nil {
+				return err
+			}
+		}
+		urls := append([]string{strings.TrimRight(baseURL, "/") + "/mirror/" + e.sha256}, e.downloads...)
+		data, err := setJSONKey(data, "download", urls)
+		if err != nil {
+			return fmt.Errorf("Could not rewrite %s: %s", e.path, err)
+		}
+		entries[i].data = data
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteMirrored(t *testing.T) {
+	oldDir, oldConf := workspaceDir, conf
+	workspaceDir, conf = t.TempDir(), &config{}
+	t.Cleanup(func() { workspaceDir, conf = oldDir, oldConf })
+	store := mirrorStore()
+	if err := os.MkdirAll(store.dir, DirPerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.path("AA"), []byte("zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries := []repoEntry{
+		{
+			name:      "Mirrored-1.0",
+			sha256:    "AA",
+			downloads: []string{"https://a.example/mod.zip", "https://b.example/mod.zip"},
+			data:      []byte(`{"download": ["https://a.example/mod.zip", "https://b.example/mod.zip"]}`),
+		},
+		{
+			name:      "Other-1.0",
+			sha256:    "BB",
+			downloads: []string{"https://a.example/other.zip"},
+			data:      []byte(`{"download": "https://a.example/other.zip"}`),
+		},
+	}
+	if err := rewriteMirrored(entries, "https://kure.example/"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		// mirror first, original urls as fallbacks
+		{"Mirrored-1.0", []string{"https://kure.example/mirror/AA", "https://a.example/mod.zip", "https://b.example/mod.zip"}},
+		{"Other-1.0", []string{"https://a.example/other.zip"}},
+	}
+	for i, tt := range tests {
+		var ckan struct {
+			Download interface{} `json:"download"`
+		}
+		if err := json.Unmarshal(entries[i].data, &ckan); err != nil {
+			t.Fatal(err)
+		}
+		if got := downloadURLs(ckan.Download); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s downloads from %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
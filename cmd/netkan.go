@@ -0,0 +1,319 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/ryanuber/columnize"
+	"github.com/spf13/cobra"
+	"github.com/ungerik/go-dry"
+)
+
+// defaultNetkan is name of netkan.exe downloaded by `kure update -n`
+const defaultNetkan = "default"
+
+// netkanReleaseURL is where released netkan.exe versions are downloaded from
+const netkanReleaseURL = "https://github.com/KSP-CKAN/CKAN/releases/download/v%s/netkan.exe"
+
+var (
+	netkanInstallName   string
+	netkanInstallSHA256 string
+)
+
+// netkanCmd represents the netkan command
+var netkanCmd = &cobra.Command{
+	Use:   "netkan",
+	Short: "Manage netkan.exe versions installed in workspace",
+	Long: `Workspace can hold several netkan.exe versions side by side in cache/bin/netkan.
+	One of them is active and used by "kure build". netkan.exe downloaded with "kure update -n"
+	is called default.`,
+}
+
+var netkanInstallCmd = &cobra.Command{
+	Use:   "install version|url",
+	Short: "Download netkan.exe release or file from url",
+	Long: `Download netkan.exe release, for example "kure netkan install 1.30.4", or netkan.exe
+	from given url. Version of file from url is taken from url or can be set with --name.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
+		if len(args) != 1 {
+			return errors.New("You need to provide version or url as argument!")
+		}
+		version, url := netkanSource(args[0])
+		if netkanInstallName != "" {
+			version = netkanInstallName
+		}
+		if version == "" {
+			return errors.New("Could not guess version from url, set it with --name")
+		}
+		if version == defaultNetkan {
+			return errors.New("Version name `default` is reserved for `kure update -n`")
+		}
+		dir := netkanDir(version)
+		err := os.MkdirAll(dir, DirPerm)
+		if err != nil {
+			return err
+		}
+		_, err = installNetkanFile(url, netkanInstallSHA256, filepath.Join(dir, "netkan.exe"))
+		if err != nil {
+			return err
+		}
+		if netkanInstallSHA256 == "" {
+			fmt.Println("Use --sha256 to verify downloaded file.")
+		}
+		Done("Installed netkan %s\n", version)
+		fmt.Printf("Run `kure netkan use %s` to make it active.\n", version)
+		return nil
+	},
+}
+
+var netkanListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List installed netkan.exe versions",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		versions, err := installedNetkans()
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			Warn("No netkan.exe installed\n")
+			fmt.Println("Run `kure update -n` or `kure netkan install <version>`.")
+			return nil
+		}
+		state, err := loadState()
+		if err != nil {
+			return err
+		}
+		active := state.Netkan
+		if active == "" {
+			active = defaultNetkan
+		}
+		mark := color.New(color.FgHiGreen, color.Bold).SprintFunc()
+		var result []string
+		for _, v := range versions {
+			path, err := netkanPath(v)
+			if err != nil {
+				return err
+			}
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			current := " "
+			if v == active {
+				current = mark("*")
+			}
+			result = append(result, fmt.Sprintf("%s | %s | %s", current, v, sum))
+		}
+		fmt.Println(columnize.SimpleFormat(result))
+		return nil
+	},
+}
+
+var netkanUseCmd = &cobra.Command{
+	Use:   "use version",
+	Short: "Make installed netkan.exe version active",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
+		if len(args) != 1 {
+			return errors.New("You need to provide version as argument!")
+		}
+		version := args[0]
+		path, err := netkanPath(version)
+		if err != nil {
+			return err
+		}
+		if !dry.FileExists(path) {
+			return fmt.Errorf("netkan %s is not installed", version)
+		}
+		state, err := loadState()
+		if err != nil {
+			return err
+		}
+		state.Netkan = version
+		if version == defaultNetkan {
+			state.Netkan = ""
+		}
+		err = state.save()
+		if err != nil {
+			return err
+		}
+		Done("Using netkan %s\n", version)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(netkanCmd)
+	netkanCmd.AddCommand(netkanInstallCmd)
+	netkanCmd.AddCommand(netkanListCmd)
+	netkanCmd.AddCommand(netkanUseCmd)
+	netkanInstallCmd.Flags().StringVar(&netkanInstallName, "name", "", "Version name of installed netkan.exe")
+	netkanInstallCmd.Flags().StringVar(&netkanInstallSHA256, "sha256", "", "Expected sha256 of netkan.exe")
+}
+
+// netkanSource turns install argument into version and url. Version is empty
+// if it can't be guessed from url.
+func netkanSource(arg string) (version, rawurl string) {
+	if !strings.Contains(arg, "/") {
+		version = strings.TrimPrefix(arg, "v")
+		return version, fmt.Sprintf(netkanReleaseURL, version)
+	}
+	// github release urls look like .../releases/download/v1.30.4/netkan.exe
+	u, err := url.Parse(arg)
+	if err == nil {
+		dir := path.Base(path.Dir(u.Path))
+		if dir != "." && dir != "/" && dir != "download" {
+			version = strings.TrimPrefix(dir, "v")
+		}
+	}
+	return version, arg
+}
+
+func netkanDir(version string) string {
+	return workspacePath("cache", "bin", "netkan", version)
+}
+
+// netkanPath returns path of netkan.exe with given version
+func netkanPath(version string) (string, error) {
+	if version == defaultNetkan {
+		return workspacePath("cache", "bin", "netkan.exe"), nil
+	}
+	if version == "" || strings.ContainsAny(version, `/\`) || version == "." || version == ".." {
+		return "", fmt.Errorf("Invalid netkan version `%s`", version)
+	}
+	return filepath.Join(netkanDir(version), "netkan.exe"), nil
+}
+
+// activeNetkan returns version and path of netkan.exe used for builds.
+// override takes precedence over version selected with `kure netkan use`.
+func activeNetkan(override string) (string, string, error) {
+	version := override
+	if version == "" {
+		state, err := loadState()
+		if err != nil {
+			return "", "", err
+		}
+		version = state.Netkan
+	}
+	if version == "" {
+		version = defaultNetkan
+	}
+	path, err := netkanPath(version)
+	if err != nil {
+		return "", "", err
+	}
+	if !dry.FileExists(path) {
+		if version == defaultNetkan {
+			return "", "", errors.New("There is no netkan.exe in cache/bin, run `kure update -n` first")
+		}
+		return "", "", fmt.Errorf("netkan %s is not installed, run `kure netkan install %s` first", version, version)
+	}
+	return version, path, nil
+}
+
+// installedNetkans returns sorted names of installed versions
+func installedNetkans() ([]string, error) {
+	var versions []string
+	path, err := netkanPath(defaultNetkan)
+	if err != nil {
+		return nil, err
+	}
+	if dry.FileExists(path) {
+		versions = append(versions, defaultNetkan)
+	}
+	dir := netkanDir("")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var installed []string
+	for _, e := range entries {
+		if e.IsDir() && dry.FileExists(filepath.Join(dir, e.Name(), "netkan.exe")) {
+			installed = append(installed, e.Name())
+		}
+	}
+	sort.Strings(installed)
+	return append(versions, installed...), nil
+}
+
+// installNetkanFile downloads netkan.exe to path. New file is verified
+// against pin before it replaces previous one. Returns sha256 of new file.
+func installNetkanFile(url, pin, path string) (string, error) {
+	pin = strings.ToLower(pin)
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, DirPerm)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, "netkan-")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	shared, err := sharedBlobs()
+	if err != nil {
+		return "", err
+	}
+	sum := pin
+	if shared.has(pin) {
+		err = shared.get(pin, tmp.Name())
+		if err != nil {
+			return "", err
+		}
+	} else {
+		_, err = tryURLs(mirrorURLs(url, nil), func(url string) error {
+			return downloadFile(url, tmp.Name(), true, nil)
+		})
+		if err != nil {
+			return "", err
+		}
+		sum, err = hashFile(tmp.Name())
+		if err != nil {
+			return "", err
+		}
+		if pin == "" {
+			Warn("netkan.exe is not pinned, downloaded file has sha256 %s\n", sum)
+		} else if pin != sum {
+			return "", fmt.Errorf("Downloaded netkan.exe has sha256 %s, expected %s. Keeping previous netkan.exe", sum, pin)
+		} else if verbose {
+			fmt.Printf("netkan.exe sha256 verified: %s\n", sum)
+		}
+		err = shared.put(tmp.Name(), sum)
+		if err != nil {
+			return "", err
+		}
+	}
+	// copy from shared cache keeps mode of the blob, which is not executable
+	err = os.Chmod(tmp.Name(), 0700)
+	if err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,455 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ryanuber/columnize"
+)
+
+// archiveFormats are supported formats of repository archive
+var archiveFormats = []string{"tar.gz", "zip"}
+
+// archiveTime is modification time of every archived file, so the same ckans
+// always give the same archive. Zip can't store older dates.
+var archiveTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// repoEntry is ckan file packed into served repository
+type repoEntry struct {
+	// path inside archive
+	name string
+	// file on disk
+	path       string
+	identifier string
+	version    string
+	depends    []ckanRelation
+	provides   []string
+	downloads  []string
+	size       int64
+	// lowercase sha256 of download, empty if unknown
+	sha256 string
+	// generated content, packed instead of file at path
+	data []byte
+}
+
+// shadowedEntry is upstream ckan left out because of local one
+type shadowedEntry struct {
+	upstream repoEntry
+	local    repoEntry
+	// same version is replaced, other versions are dropped when configured
+	reason string
+}
+
+// readCkan reads ckan file into entry named like in CKAN-Meta
+func readCkan(path string) (repoEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return repoEntry{}, err
+	}
+	var ckan struct {
+		Identifier string         `json:"identifier"`
+		Version    string         `json:"version"`
+		Depends    []ckanRelation `json:"depends"`
+		Provides   []string       `json:"provides"`
+		// url or list of urls
+		Download     interface{} `json:"download"`
+		DownloadSize int64       `json:"download_size"`
+		DownloadHash struct {
+			SHA256 string `json:"sha256"`
+		} `json:"download_hash"`
+	}
+	err = json.Unmarshal(data, &ckan)
+	if err != nil {
+		return repoEntry{}, fmt.Errorf("Could not read %s: %s", path, err)
+	}
+	if ckan.Identifier == "" || ckan.Version == "" {
+		return repoEntry{}, fmt.Errorf("%s has no identifier or version", path)
+	}
+	return repoEntry{
+		name:       ckan.Identifier + "/" + filepath.Base(path),
+		path:       path,
+		identifier: ckan.Identifier,
+		version:    ckan.Version,
+		depends:    ckan.Depends,
+		provides:   ckan.Provides,
+		downloads:  downloadURLs(ckan.Download),
+		size:       ckan.DownloadSize,
+		sha256:     strings.ToLower(ckan.DownloadHash.SHA256),
+	}, nil
+}
+
+func downloadURLs(download interface{}) []string {
+	switch d := download.(type) {
+	case string:
+		return []string{d}
+	case []interface{}:
+		var urls []string
+		for _, u := range d {
+			if s, ok := u.(string); ok {
+				urls = append(urls, s)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
+// localCkans lists ckan files of local directories, like local/ckan
+func localCkans(dirs []string) ([]repoEntry, error) {
+	var entries []repoEntry
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != ".ckan" {
+				continue
+			}
+			e, err := readCkan(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// upstreamCkans lists ckan files of downloaded ckan repos, like CKAN-Meta
+func upstreamCkans() ([]repoEntry, error) {
+	var entries []repoEntry
+	found := false
+	for _, repo := range conf.Repos {
+		if repo.Type != "ckan" {
+			continue
+		}
+		dir := workspacePath("cache", "repo", repo.Name)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return nil, fmt.Errorf("Repo %s is not downloaded, run `kure update` first", repo.Name)
+		}
+		found = true
+		err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if f.IsDir() && f.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if f.IsDir() || filepath.Ext(path) != ".ckan" {
+				return nil
+			}
+			e, err := readCkan(path)
+			if err != nil {
+				if verbose {
+					Warn("Skipping %s\n", err)
+				}
+				return nil
+			}
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("There are no ckan repos in workspace, see `kure repo list-available` and add one with `kure repo add <name>`")
+	}
+	return entries, nil
+}
+
+// overlayCkans puts local entries over upstream ones. Upstream entry with
+// the same identifier and version is replaced. If identifier is listed in
+// drop, all its upstream versions are dropped; "*" matches every identifier.
+func overlayCkans(local, upstream []repoEntry, drop []string) ([]repoEntry, []shadowedEntry) {
+	byVersion := make(map[string]repoEntry)
+	byIdentifier := make(map[string]repoEntry)
+	for _, l := range local {
+		byVersion[l.identifier+"\x00"+l.version] = l
+		byIdentifier[l.identifier] = l
+	}
+	dropAll := contains(drop, "*")
+	entries := append([]repoEntry{}, local...)
+	seen := make(map[string]bool)
+	var shadowed []shadowedEntry
+	for _, u := range upstream {
+		// the same ckan may come from more repos
+		if seen[u.name] {
+			continue
+		}
+		seen[u.name] = true
+		if l, found := byVersion[u.identifier+"\x00"+u.version]; found {
+			shadowed = append(shadowed, shadowedEntry{upstream: u, local: l, reason: "replaced"})
+			continue
+		}
+		if l, found := byIdentifier[u.identifier]; found && (dropAll || contains(drop, u.identifier)) {
+			shadowed = append(shadowed, shadowedEntry{upstream: u, local: l, reason: "dropped"})
+			continue
+		}
+		entries = append(entries, u)
+	}
+	sort.Slice(shadowed, func(i, j int) bool {
+		return shadowed[i].upstream.name < shadowed[j].upstream.name
+	})
+	return entries, shadowed
+}
+
+// archiveFormat guesses format of repository archive from its name
+func archiveFormat(path string) string {
+	if strings.HasSuffix(path, ".zip") {
+		return "zip"
+	}
+	return "tar.gz"
+}
+
+// writeRepoArchive packs entries into tar.gz or zip repository. Entries are
+// sorted and have fixed time and permissions. Archive is written to temporary
+// file first, so clients never download half written one.
+func writeRepoArchive(entries []repoEntry, dest, format string) error {
+	err := os.MkdirAll(filepath.Dir(dest), DirPerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".pack-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sorted := append([]repoEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+	if format == "zip" {
+		err = writeZip(tmp, sorted)
+	} else {
+		err = writeTarGz(tmp, sorted)
+	}
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func writeTarGz(w io.Writer, entries []repoEntry) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		err := addTarFile(tw, e)
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// openEntry opens content of archived entry
+func openEntry(e repoEntry) (io.ReadCloser, int64, error) {
+	if e.data != nil {
+		return ioutil.NopCloser(bytes.NewReader(e.data)), int64(len(e.data)), nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func addTarFile(tw *tar.Writer, e repoEntry) error {
+	f, size, err := openEntry(e)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:     e.name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  archiveTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func writeZip(w io.Writer, entries []repoEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		h := &zip.FileHeader{
+			Name:     e.name,
+			Method:   zip.Deflate,
+			Modified: archiveTime,
+		}
+		h.SetMode(0644)
+		fw, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		f, _, err := openEntry(e)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// repoPack is content of served or exported repository
+type repoPack struct {
+	entries []repoEntry
+	// repository files other than ckans, like download_counts.json
+	extras   []repoEntry
+	shadowed []shadowedEntry
+	// unresolved dependencies of curated mods
+	warnings []string
+	// curation file, empty when all ckans are packed
+	curation string
+}
+
+// files lists everything packed into archive
+func (p *repoPack) files() []repoEntry {
+	return append(append([]repoEntry{}, p.entries...), p.extras...)
+}
+
+// packOptions changes what is packed besides ckans
+type packOptions struct {
+	// add upstream download counts of packed mods
+	downloadCounts bool
+	// base url of server hosting local/files and mirror
+	baseURL string
+	// point downloads of mirrored archives at server
+	mirror bool
+}
+
+// repoEntries lists ckans of channel: local ones only, overlaid over
+// upstream, or curated subset of overlay when channel has curation file.
+// Downloads of hosted files, and of mirrored archives when asked, are
+// rewritten to point at server.
+func repoEntries(ch channelConfig, opts packOptions) (*repoPack, error) {
+	p, err := packCkans(ch)
+	if err != nil {
+		return nil, err
+	}
+	err = rewriteDownloads(p.entries, opts.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.mirror {
+		err = rewriteMirrored(p.entries, opts.baseURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ch.Overlay || p.curation != "" {
+		builds, err := upstreamBuilds()
+		if err != nil {
+			return nil, err
+		}
+		if builds != nil {
+			p.extras = append(p.extras, *builds)
+		}
+	}
+	if opts.downloadCounts {
+		counts, err := downloadCountsEntry(p.entries)
+		if err != nil {
+			return nil, err
+		}
+		p.extras = append(p.extras, counts)
+	}
+	return p, nil
+}
+
+func packCkans(ch channelConfig) (*repoPack, error) {
+	cur, err := ch.loadCuration()
+	if err != nil {
+		return nil, err
+	}
+	local, err := localCkans(ch.dirs())
+	if err != nil {
+		return nil, err
+	}
+	if !ch.Overlay && cur == nil {
+		return &repoPack{entries: ch.filter(local)}, nil
+	}
+	upstream, err := upstreamCkans()
+	if err != nil {
+		return nil, err
+	}
+	p := &repoPack{}
+	p.entries, p.shadowed = overlayCkans(local, upstream, conf.OverlayDropUpstream)
+	p.entries = ch.filter(p.entries)
+	if cur != nil {
+		p.curation = ch.Curation
+		p.entries, p.warnings, err = cur.subset(p.entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// report prints shadowed ckans, curation problems and changes since
+// archive at previous path
+func (p *repoPack) report(previous string) error {
+	if len(p.shadowed) > 0 {
+		Warn("%d upstream ckans are shadowed by local ones:\n", len(p.shadowed))
+		fmt.Println(columnize.SimpleFormat(shadowReport(p.shadowed)))
+	}
+	for _, w := range p.warnings {
+		Warn("%s\n", w)
+	}
+	if p.curation != "" {
+		fmt.Printf("Curated subset from %s has %d ckans\n", p.curation, len(p.entries))
+	}
+	return printArchiveDiff(previous, p.files())
+}
+
+// shadowReport formats shadowed entries as table
+func shadowReport(shadowed []shadowedEntry) []string {
+	lines := []string{"identifier | version | shadowed | upstream | local"}
+	for _, s := range shadowed {
+		lines = append(lines, fmt.Sprintf("%s | %s | %s | %s | %s",
+			s.upstream.identifier, s.upstream.version, s.reason,
+			strings.TrimPrefix(s.upstream.path, workspacePath("cache", "repo")+string(os.PathSeparator)),
+			filepath.Base(s.local.path)))
+	}
+	return lines
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOverlayCkans(t *testing.T) {
+	local := []repoEntry{entry("Mod", "1.1"), entry("Own", "1.0")}
+	upstream := []repoEntry{
+		entry("Mod", "1.0"),
+		entry("Mod", "1.1"),
+		entry("Other", "2.0"),
+		// the same ckan from second repo
+		entry("Other", "2.0"),
+	}
+	tests := []struct {
+		name     string
+		drop     []string
+		want     []string
+		shadowed []string
+	}{
+		{
+			name:     "replace",
+			want:     []string{"Mod-1.0", "Mod-1.1", "Other-2.0", "Own-1.0"},
+			shadowed: []string{"Mod-1.1 replaced"},
+		},
+		{
+			name:     "drop",
+			drop:     []string{"Mod"},
+			want:     []string{"Mod-1.1", "Other-2.0", "Own-1.0"},
+			shadowed: []string{"Mod-1.0 dropped", "Mod-1.1 replaced"},
+		},
+		{
+			// upstream mods without local ckans are kept
+			name:     "drop all",
+			drop:     []string{"*"},
+			want:     []string{"Mod-1.1", "Other-2.0", "Own-1.0"},
+			shadowed: []string{"Mod-1.0 dropped", "Mod-1.1 replaced"},
+		},
+		{
+			name:     "drop without local",
+			drop:     []string{"Other"},
+			want:     []string{"Mod-1.0", "Mod-1.1", "Other-2.0", "Own-1.0"},
+			shadowed: []string{"Mod-1.1 replaced"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, shadowed := overlayCkans(local, upstream, tt.drop)
+			if got := entryNames(entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries are %v, want %v", got, tt.want)
+			}
+			var got []string
+			for _, s := range shadowed {
+				got = append(got, s.upstream.name+" "+s.reason)
+				if s.local.identifier != s.upstream.identifier {
+					t.Errorf("%s shadowed by %s", s.upstream.name, s.local.name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.shadowed) {
+				t.Errorf("shadowed are %v, want %v", got, tt.shadowed)
+			}
+		})
+	}
+	// replaced upstream entry is the local one
+	entries, _ := overlayCkans([]repoEntry{{name: "Mod-1.1", identifier: "Mod", version: "1.1", path: "local"}}, upstream, nil)
+	for _, e := range entries {
+		if e.name == "Mod-1.1" && e.path != "local" {
+			t.Errorf("Mod-1.1 comes from %q, want local", e.path)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/fatih/color"
+	"github.com/ryanuber/columnize"
+	"github.com/spf13/cobra"
+	"github.com/ungerik/go-dry"
+)
+
+// ckanRepositories is master list of metadata repos known to CKAN client
+const ckanRepositories = "https://raw.githubusercontent.com/KSP-CKAN/CKAN-meta/master/repositories.json"
+
+var (
+	repoFrom string
+	repoURL  string
+	repoType string
+)
+
+// availableRepo is entry of CKAN repositories.json
+type availableRepo struct {
+	Name     string `json:"name"`
+	URI      string `json:"uri"`
+	Priority int    `json:"priority"`
+	Comment  string `json:"x_comment"`
+}
+
+// repoCmd represents the repo command
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Manage repos listed in kure.json",
+	Long: `Add, remove and list repos downloaded by "kure update". Repos can be picked
+	from list of metadata repos published by CKAN.`,
+}
+
+var repoListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List repos of workspace",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		repos := conf.Repos
+		if len(repos) == 0 {
+			Warn("There are no repos in kure.json\n")
+			return nil
+		}
+		result := []string{"name | type | source | url"}
+		for _, r := range repos {
+			source := r.Source
+			if source == "" {
+				source = guessSourceKind(r.URL)
+			}
+			result = append(result, fmt.Sprintf("%s | %s | %s | %s", r.Name, r.Type, source, redactURL(r.URL)))
+		}
+		fmt.Println(columnize.SimpleFormat(result))
+		return nil
+	},
+}
+
+var repoListAvailableCmd = &cobra.Command{
+	Use:   "list-available",
+	Short: "List metadata repos published by CKAN",
+	Long: `List metadata repos from CKAN repositories.json. Use --from to read other
+	repositories.json, from url or file. Repos already in workspace are marked with *.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(sharedLock); c != nil {
+			return c
+		}
+		available, err := availableRepos(repoFrom)
+		if err != nil {
+			return err
+		}
+		mark := color.New(color.FgHiGreen, color.Bold).SprintFunc()
+		result := []string{"  | name | url | comment"}
+		for _, a := range available {
+			added := " "
+			for _, r := range conf.Repos {
+				if r.Name == a.Name || r.URL == a.URI {
+					added = mark("*")
+				}
+			}
+			result = append(result, fmt.Sprintf("%s | %s | %s | %s", added, a.Name, a.URI, a.Comment))
+		}
+		fmt.Println(columnize.SimpleFormat(result))
+		Done("Run `kure repo add <name>` to add repo to workspace.\n")
+		return nil
+	},
+}
+
+var repoAddCmd = &cobra.Command{
+	Use:   "add name",
+	Short: "Add repo to kure.json",
+	Long: `Add repo from CKAN repositories.json (see "kure repo list-available") to kure.json.
+	With --url any repo can be added, for example "kure repo add my-netkans --type netkan --url ../netkans".`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
+		if len(args) != 1 {
+			return errors.New("You need to provide repo name as argument!")
+		}
+		repo := repoConfig{Name: args[0], Type: repoType, URL: repoURL}
+		if repo.URL != "" && isLocalURL(repo.URL) && localPath(repo.URL) == repo.URL && !filepath.IsAbs(repo.URL) {
+			// kure.json paths are relative to workspace root
+			abs, err := filepath.Abs(repo.URL)
+			if err != nil {
+				return err
+			}
+			repo.URL, err = filepath.Rel(workspaceDir, abs)
+			if err != nil {
+				return err
+			}
+		}
+		if repo.URL == "" {
+			available, err := availableRepos(repoFrom)
+			if err != nil {
+				return err
+			}
+			for _, a := range available {
+				if a.Name == repo.Name {
+					// repositories.json lists only ckan metadata repos
+					repo.URL, repo.Type = a.URI, "ckan"
+				}
+			}
+			if repo.URL == "" {
+				return fmt.Errorf("Repo `%s` not found, see `kure repo list-available`", repo.Name)
+			}
+		}
+		if repo.Type != "ckan" && repo.Type != "netkan" {
+			return fmt.Errorf("Repo type must be ckan or netkan, got `%s`", repo.Type)
+		}
+		if guessSourceKind(repo.URL) == "zip" {
+			repo.Source = "zip"
+		}
+
+		entries, err := rawRepos()
+		if err != nil {
+			return err
+		}
+		for _, r := range conf.Repos {
+			if r.Name == repo.Name {
+				return fmt.Errorf("Repo `%s` is already in kure.json", repo.Name)
+			}
+		}
+		entry, err := json.Marshal(repo)
+		if err != nil {
+			return err
+		}
+		err = writeRawRepos(append(entries, entry))
+		if err != nil {
+			return err
+		}
+		Done("Added %s repo %s\n", repo.Type, repo.Name)
+		fmt.Println("Run `kure update` to download it.")
+		return nil
+	},
+}
+
+var repoRemoveCmd = &cobra.Command{
+	Use:   "remove name",
+	Short: "Remove repo from kure.json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if c := checkWorkspace(); c != nil {
+			return c
+		}
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
+		if len(args) != 1 {
+			return errors.New("You need to provide repo name as argument!")
+		}
+		entries, err := rawRepos()
+		if err != nil {
+			return err
+		}
+		var kept []json.RawMessage
+		for _, e := range entries {
+			var r repoConfig
+			if json.Unmarshal(e, &r) == nil && r.Name == args[0] {
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if len(kept) == len(entries) {
+			return fmt.Errorf("Repo `%s` is not in kure.json", args[0])
+		}
+		err = writeRawRepos(kept)
+		if err != nil {
+			return err
+		}
+		Done("Removed repo %s\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(repoCmd)
+	repoCmd.AddCommand(repoListCmd)
+	repoCmd.AddCommand(repoListAvailableCmd)
+	repoCmd.AddCommand(repoAddCmd)
+	repoCmd.AddCommand(repoRemoveCmd)
+	repoListAvailableCmd.Flags().StringVarP(&repoFrom, "from", "f", ckanRepositories, "Url or file with repositories.json")
+	repoAddCmd.Flags().StringVarP(&repoFrom, "from", "f", ckanRepositories, "Url or file with repositories.json")
+	repoAddCmd.Flags().StringVarP(&repoURL, "url", "u", "", "Url of repo that is not in repositories.json")
+	repoAddCmd.Flags().StringVarP(&repoType, "type", "t", "netkan", "Type of repo added with --url, ckan or netkan")
+}
+
+// availableRepos reads CKAN repositories.json from url or file
+func availableRepos(from string) ([]availableRepo, error) {
+	if verbose {
+		fmt.Printf("Reading %s\n", redactURL(from))
+	}
+	data, err := dry.FileGetBytes(localPath(from))
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Repositories []availableRepo `json:"repositories"`
+	}
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", redactURL(from), err)
+	}
+	return list.Repositories, nil
+}
+
+// rawRepos returns repo entries of kure.json as they are written
+func rawRepos() ([]json.RawMessage, error) {
+	data, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Repos []json.RawMessage `json:"repos"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	return config.Repos, nil
+}
+
+// writeRawRepos replaces repos of kure.json leaving other settings untouched
+func writeRawRepos(repos []json.RawMessage) error {
+	if repos == nil {
+		repos = []json.RawMessage{}
+	}
+	return editConfigFile(confPath, func(data []byte) ([]byte, error) {
+		return setJSONKey(data, "repos", repos)
+	})
+}
@@ -3,18 +3,30 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"errors"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"github.com/ungerik/go-dry"
 )
 
 var (
-	cfgFile     string
-	inWorkspace = false
-	verbose     = false
+	cfgFile string
+	// workspaceFlag selects workspace instead of looking for it
+	workspaceFlag string
+	// workspaceDir is absolute path of workspace root
+	workspaceDir string
+	inWorkspace  = false
+	verbose      = false
+	// confPath is path of workspace config file
+	confPath string
+	// conf is workspace config, loaded once by initConfig
+	conf *config
+	// confErr tells why workspace config could not be loaded
+	confErr error
 
 	//disable color output
 	colorOff = false
@@ -41,7 +53,9 @@ var RootCmd = &cobra.Command{
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	err := RootCmd.Execute()
+	releaseWorkspace()
+	if err != nil {
 		os.Exit(-1)
 	}
 }
@@ -50,38 +64,116 @@ func init() {
 	cobra.OnInitialize(initConfig)
 	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	RootCmd.PersistentFlags().BoolVarP(&colorOff, "no-color", "N", false, "Disable colorful output")
+	RootCmd.PersistentFlags().StringVarP(&workspaceFlag, "workspace", "C", "",
+		"Use workspace in given directory instead of looking for kure.json in current and parent directories")
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Workspace config file (default is kure.json in workspace root)")
+	RootCmd.PersistentFlags().BoolVar(&waitLock, "wait", false, "Wait for other kure command using workspace instead of failing")
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig reads in config file.
 func initConfig() {
-	if cfgFile != "" { // enable ability to specify config file via flag
-		viper.SetConfigFile(cfgFile)
+	user, userErr := loadUserConfig()
+	//disable color on flag or in config
+	if colorOff || (user != nil && user.NoColor) {
+		color.NoColor = true
 	}
 
-	//disable color on flag
-	if colorOff {
+	var err error
+	workspaceDir, err = findWorkspace()
+	if err != nil {
+		confErr = err
+		return
+	}
+	confPath = filepath.Join(workspaceDir, "kure.json")
+	if cfgFile != "" { // enable ability to specify config file via flag
+		confPath, _ = filepath.Abs(cfgFile)
+	}
+	if !dry.FileExists(confPath) {
+		if userErr != nil {
+			Warn("Ignoring user config: %s\n", userErr)
+		}
+		if workspaceFlag != "" || cfgFile != "" {
+			confErr = fmt.Errorf("%s does not exist, it's not a workspace", confPath)
+		}
+		return
+	}
+	inWorkspace = true
+	if userErr != nil {
+		confErr = userErr
+		return
+	}
+	if verbose {
+		if userConfig != nil {
+			fmt.Println("Using user config file:", userConfigFile)
+		}
+		fmt.Println("Using workspace config file:", confPath)
+	}
+	conf, confErr = loadConfig(confPath)
+	if conf != nil && conf.NoColor {
 		color.NoColor = true
 	}
+}
 
-	viper.SetConfigName("kure") // name of config file (without extension)
-	viper.AddConfigPath(".")    // adding current directory
-	viper.AutomaticEnv()        // read in environment variables that match
-
-	//defaults
-	viper.SetDefault("cachedir", "./cache/download/")
+func checkWorkspace() error {
+	if !inWorkspace && confErr == nil {
+		return errors.New("This command can only be called from workspace! Run it in workspace directory or use -C")
+	}
+	return confErr
+}
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		inWorkspace = true
-		if verbose {
-			fmt.Println("Using workspace config file:", viper.ConfigFileUsed())
+// findWorkspace returns directory selected with -C, directory of --config
+// file or first directory with kure.json, starting from current one and
+// going up
+func findWorkspace() (string, error) {
+	if workspaceFlag != "" {
+		dir, err := filepath.Abs(workspaceFlag)
+		if err != nil {
+			return "", err
+		}
+		if !dry.FileIsDir(dir) {
+			return "", fmt.Errorf("Workspace directory %s does not exist", dir)
+		}
+		return dir, nil
+	}
+	if cfgFile != "" {
+		path, err := filepath.Abs(cfgFile)
+		return filepath.Dir(path), err
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for dir := pwd; ; dir = filepath.Dir(dir) {
+		if dry.FileExists(filepath.Join(dir, "kure.json")) {
+			return dir, nil
+		}
+		if filepath.Dir(dir) == dir {
+			// not in workspace, paths are relative to current directory
+			return pwd, nil
 		}
 	}
 }
 
-func checkWorkspace() error {
-	if !inWorkspace {
-		return errors.New("This command can only be called from workspace!")
+// workspacePath joins path elements to workspace root
+func workspacePath(elem ...string) string {
+	return filepath.Join(append([]string{workspaceDir}, elem...)...)
+}
+
+// workspaceRel returns path relative to workspace root with forward slashes,
+// so it's the same on every platform. Paths outside workspace are returned
+// unchanged.
+func workspaceRel(path string) string {
+	rel, err := filepath.Rel(workspaceDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// workspaceAbs resolves path from config file against workspace root
+func workspaceAbs(path string) string {
+	if filepath.IsAbs(path) {
+		return path
 	}
-	return nil
+	return workspacePath(path)
 }
@@ -21,61 +21,493 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/mholt/archiver"
 	"github.com/spf13/cobra"
 )
 
-var port string
+var (
+	port                string
+	serveOverlay        = false
+	servePoll           time.Duration
+	serveDownloadCounts = false
+	serveBaseURL        string
+	serveMirror         = false
+	serveBind           string
+	serveTLSCert        string
+	serveTLSKey         string
+	serveTLSSelfSigned  = false
+	serveAccessLog      string
+	serveMetrics        = false
+)
 
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Pack your ckans into tar.gz and start local web server that will host this file.",
 	Long: `Local web server allows you to load your ckans directly into ckan client, like from
-	ordinary ckan repository.`,
+	ordinary ckan repository. See README for overlay, channels, curation, hosted files and auth.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if c := checkWorkspace(); c != nil {
 			return c
 		}
-		pwd, _ := os.Getwd()
-		// pack repository
-		localPath := filepath.Join("local", "ckan")
-		if verbose {
-			fmt.Printf("Adding files from %s\n", localPath)
+		// workspace is locked by every rebuild, not for the life of server
+		if !contains(accessLogFormats, serveAccessLog) {
+			return fmt.Errorf("Unknown access log format %s, use one of: %s", serveAccessLog, strings.Join(accessLogFormats, ", "))
 		}
-		files, err := ioutil.ReadDir(localPath)
-		if err != nil {
-			return err
+		srv := &http.Server{Addr: net.JoinHostPort(serveBind, port)}
+		scheme := "http"
+		switch {
+		case serveTLSSelfSigned && serveTLSCert != "":
+			return errors.New("Use either --tls-self-signed or --tls-cert, not both")
+		case (serveTLSCert == "") != (serveTLSKey == ""):
+			return errors.New("TLS needs both --tls-cert and --tls-key")
+		case serveTLSCert != "":
+			cert, err := tls.LoadX509KeyPair(serveTLSCert, serveTLSKey)
+			if err != nil {
+				return err
+			}
+			srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			scheme = "https"
+		case serveTLSSelfSigned:
+			cert, err := selfSignedCert(publicHost(serveBind))
+			if err != nil {
+				return err
+			}
+			srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			scheme = "https"
+			Warn("Using self-signed certificate, clients must trust it. SHA-256 fingerprint:\n")
+			fmt.Println(certFingerprint(cert))
+		}
+		public := scheme + "://" + net.JoinHostPort(publicHost(serveBind), port)
+		if serveBaseURL == "" && !wildcardBind(serveBind) {
+			// localhost can't be written into ckans, other machines may
+			// be served too
+			serveBaseURL = public
+		}
+		if serveMirror && serveBaseURL == "" {
+			return errors.New("--mirror writes URL of this server into ckans, set --base-url or --bind")
+		}
+
+		s := newRepoServer(servedChannels(serveOverlay))
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", s.serveIndex)
+		for _, ch := range s.channels {
+			mux.HandleFunc("/"+ch.config.archive(), ch.serveArchive)
+		}
+		mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(workspacePath("local", "files")))))
+		if serveMirror {
+			mux.Handle("/mirror/", http.StripPrefix("/mirror/", http.FileServer(http.Dir(mirrorStore().dir))))
 		}
-		var fileNames []string
-		for _, f := range files {
-			fileNames = append(fileNames, filepath.Join(localPath, f.Name()))
+		mux.HandleFunc("/rebuild", s.serveRebuild)
+		mux.HandleFunc("/repositories.json", s.serveRepositories)
+		if serveMetrics {
+			mux.HandleFunc("/metrics", s.serveMetrics)
 		}
-		if verbose {
-			fmt.Println("Creating tar.gz")
+		var handler http.Handler = mux
+		if conf.ServeAuth != nil {
+			var err error
+			handler, err = requireAuth(conf.ServeAuth, mux)
+			if err != nil {
+				return err
+			}
+			if scheme == "http" {
+				Warn("Credentials of serve_auth are sent unencrypted, use TLS outside trusted network\n")
+			}
+		}
+		// health checks come without credentials
+		root := http.NewServeMux()
+		root.HandleFunc("/healthz", s.serveHealth)
+		root.Handle("/", handler)
+		srv.Handler = accessLog(serveAccessLog, os.Stdout, root)
+
+		err := s.rebuild()
+		if err != nil {
+			return err
 		}
-		archiver.Archive(fileNames, filepath.Join("cache", "server", "main.tar.gz"))
 
 		// serve repository
 		Done("Starting server. CTRL-C to stop. Addres:\n")
-		fmt.Printf("%s | localhost:%s/main.tar.gz\n", filepath.Base(pwd), port)
+		for _, ch := range s.channels {
+			fmt.Printf("%s | %s/%s\n", ch.title(), public, ch.config.archive())
+		}
 		Done("Paste it into CKAN-Settings>New\n")
 
-		fs := http.FileServer(http.Dir("./cache/server"))
-		http.Handle("/", fs)
-		log.Fatal(http.ListenAndServe(":"+port, nil))
-		return nil
+		if servePoll > 0 {
+			go s.watch(servePoll)
+		}
+		stopped := make(chan error, 1)
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			signal.Stop(signals)
+			Done("Stopping server, waiting for running requests\n")
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stopped <- srv.Shutdown(ctx)
+		}()
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			return err
+		}
+		return <-stopped
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(serveCmd)
 	serveCmd.Flags().StringVarP(&port, "port", "p", "8000", "localhost port")
+	serveCmd.Flags().StringVarP(&serveBind, "bind", "b", "", "Address to listen on, like 10.8.0.1, all interfaces by default")
+	serveCmd.Flags().StringVar(&serveTLSCert, "tls-cert", "", "Certificate file for HTTPS")
+	serveCmd.Flags().StringVar(&serveTLSKey, "tls-key", "", "Private key file of --tls-cert")
+	serveCmd.Flags().BoolVar(&serveTLSSelfSigned, "tls-self-signed", false, "Serve HTTPS with certificate generated at start")
+	serveCmd.Flags().BoolVarP(&serveOverlay, "overlay", "o", false, "Pack local ckans over downloaded ckan repos, dropping upstream versions of overlay_drop_upstream")
+	serveCmd.Flags().BoolVar(&serveDownloadCounts, "download-counts", false, "Pack download_counts.json with counts of packed mods from downloaded ckan repos")
+	serveCmd.Flags().StringVar(&serveBaseURL, "base-url", "", "URL of this server written into ckans downloading local/files or mirrored archives, required when listening on all interfaces")
+	serveCmd.Flags().BoolVarP(&serveMirror, "mirror", "m", false, "Serve mod archives from kure mirror under /mirror and point ckans at them")
+	serveCmd.Flags().StringVar(&serveAccessLog, "access-log", "clf", "Format of request log: clf, json or none")
+	serveCmd.Flags().BoolVar(&serveMetrics, "metrics", false, "Count downloads of channels in /metrics in Prometheus format")
+	serveCmd.Flags().DurationVar(&servePoll, "poll", 2*time.Second, "How often to check local ckans for changes, 0 disables reloading. POST /rebuild repacks right away")
+}
+
+// repoServer serves packed channels and repacks them when asked
+type repoServer struct {
+	channels []*servedChannel
+	// serializes rebuilds
+	build sync.Mutex
+}
+
+// servedChannel is packed archive of one channel
+type servedChannel struct {
+	config channelConfig
+	path   string
+	// guards archive below
+	mu      sync.RWMutex
+	data    []byte
+	etag    string
+	modTime time.Time
+	// time of last successful rebuild
+	built time.Time
+	ckans int
+	// counters of archive requests
+	downloads   int64
+	notModified int64
+}
+
+func newRepoServer(channels []channelConfig) *repoServer {
+	s := &repoServer{}
+	for _, ch := range channels {
+		s.channels = append(s.channels, &servedChannel{
+			config: ch,
+			path:   workspacePath("cache", "server", ch.archive()),
+		})
+	}
+	return s
+}
+
+// title is name of channel shown in CKAN, like workspace-testing
+func (ch *servedChannel) title() string {
+	name := filepath.Base(workspaceDir)
+	if ch.config.implicit {
+		return name
+	}
+	return name + "-" + ch.config.Name
+}
+
+// rebuild packs all channels again. Workspace is locked only while packing,
+// so other commands may run between rebuilds.
+func (s *repoServer) rebuild() error {
+	s.build.Lock()
+	defer s.build.Unlock()
+	if c := lockWorkspace(sharedLock); c != nil {
+		return c
+	}
+	defer releaseWorkspace()
+	for _, ch := range s.channels {
+		if len(s.channels) > 1 {
+			Done("Packing channel %s\n", ch.config.Name)
+		}
+		err := ch.rebuild()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ch *servedChannel) rebuild() error {
+	pack, err := repoEntries(ch.config, packOptions{downloadCounts: serveDownloadCounts, baseURL: serveBaseURL, mirror: serveMirror})
+	if err != nil {
+		return err
+	}
+	err = pack.report(ch.path)
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Println("Creating tar.gz")
+	}
+	err = writeRepoArchive(pack.files(), ch.path, "tar.gz")
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(ch.path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	ch.mu.Lock()
+	// archive is deterministic, unchanged ckans keep old version
+	if etag != ch.etag {
+		ch.data = data
+		ch.etag = etag
+		ch.modTime = time.Now()
+	}
+	ch.ckans = len(pack.entries)
+	ch.built = time.Now()
+	ch.mu.Unlock()
+	fmt.Printf("Packed %d ckans\n", len(pack.entries))
+	return nil
+}
+
+// watched lists files and directories packed into any channel, together
+// with hosted and mirrored files, which change ckans too
+func (s *repoServer) watched() []string {
+	paths := []string{workspacePath("local", "files")}
+	if serveMirror {
+		paths = append(paths, mirrorStore().dir)
+	}
+	for _, ch := range s.channels {
+		for _, p := range ch.config.watched() {
+			if !contains(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// watch polls watched paths and rebuilds channels when they change. It
+// waits until files stay the same for one interval, so half written build
+// is not packed. Failed rebuild, for example when workspace is locked, is
+// retried on next change check.
+func (s *repoServer) watch(interval time.Duration) {
+	built := snapshotFiles(s.watched())
+	last := built
+	for range time.Tick(interval) {
+		// curation file may appear and bring downloaded repos in
+		current := snapshotFiles(s.watched())
+		if current != last {
+			last = current
+			continue
+		}
+		if current == built {
+			continue
+		}
+		Done("Files changed, repacking\n")
+		err := s.rebuild()
+		if err != nil {
+			Warn("Repacking failed: %s\n", err)
+			continue
+		}
+		built = current
+	}
+}
+
+// snapshotFiles returns hash of names, sizes and modification times of all
+// files under paths. Git metadata is ignored.
+func snapshotFiles(paths []string) string {
+	var lines []string
+	for _, p := range paths {
+		filepath.Walk(p, func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if f.IsDir() && f.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			lines = append(lines, fmt.Sprintf("%s %d %d", path, f.Size(), f.ModTime().UnixNano()))
+			return nil
+		})
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		fmt.Fprintln(h, l)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serveArchive serves current archive. Clients revalidate it with ETag or
+// Last-Modified on every refresh.
+func (ch *servedChannel) serveArchive(w http.ResponseWriter, r *http.Request) {
+	ch.mu.RLock()
+	data, etag, modTime := ch.data, ch.etag, ch.modTime
+	ch.mu.RUnlock()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/gzip")
+	sw := &statusWriter{ResponseWriter: w}
+	http.ServeContent(sw, r, ch.config.archive(), modTime, bytes.NewReader(data))
+	ch.mu.Lock()
+	switch {
+	case sw.status == http.StatusNotModified:
+		ch.notModified++
+	case sw.status == http.StatusOK && r.Method == http.MethodGet:
+		ch.downloads++
+	}
+	ch.mu.Unlock()
+}
+
+// serveHealth reports build time and package count of every channel
+func (s *repoServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	type channelHealth struct {
+		Name     string    `json:"name"`
+		Packages int       `json:"packages"`
+		Built    time.Time `json:"built"`
+		Modified time.Time `json:"modified"`
+		ETag     string    `json:"etag"`
+	}
+	health := struct {
+		Status   string          `json:"status"`
+		Channels []channelHealth `json:"channels"`
+	}{Status: "ok"}
+	for _, ch := range s.channels {
+		ch.mu.RLock()
+		health.Channels = append(health.Channels, channelHealth{
+			Name:     ch.config.Name,
+			Packages: ch.ckans,
+			Built:    ch.built,
+			Modified: ch.modTime,
+			ETag:     ch.etag,
+		})
+		ch.mu.RUnlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(health)
+}
+
+// serveRebuild repacks channels on POST /rebuild
+func (s *repoServer) serveRebuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST to rebuild repository", http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.rebuild()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, ch := range s.channels {
+		ch.mu.RLock()
+		fmt.Fprintf(w, "%s: packed %d ckans, etag %s\n", ch.config.Name, ch.ckans, ch.etag)
+		ch.mu.RUnlock()
+	}
+}
+
+// servedRepository is entry of repositories.json read by CKAN client
+type servedRepository struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+// baseURL returns address of this server as seen by client
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// serveRepositories lists served channels with URLs of this server
+func (s *repoServer) serveRepositories(w http.ResponseWriter, r *http.Request) {
+	list := struct {
+		Repositories []servedRepository `json:"repositories"`
+	}{}
+	for _, ch := range s.channels {
+		list.Repositories = append(list.Repositories, servedRepository{
+			Name: ch.title(),
+			URI:  baseURL(r) + "/" + ch.config.archive(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(list)
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Add repository URL in CKAN Settings, or point it at <a href="{{.Base}}/repositories.json">{{.Base}}/repositories.json</a>.</p>
+<table>
+<tr><th>Channel</th><th>Packages</th><th>Updated</th><th>URL</th></tr>
+{{range .Channels}}<tr><td>{{.Name}}</td><td>{{.Ckans}}</td><td>{{.Updated}}</td><td><a href="{{.URL}}">{{.URL}}</a></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveIndex shows page listing channels
+func (s *repoServer) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	type channelRow struct {
+		Name    string
+		Ckans   int
+		Updated string
+		URL     string
+	}
+	page := struct {
+		Name     string
+		Base     string
+		Channels []channelRow
+	}{Name: filepath.Base(workspaceDir), Base: baseURL(r)}
+	for _, ch := range s.channels {
+		ch.mu.RLock()
+		page.Channels = append(page.Channels, channelRow{
+			Name:    ch.title(),
+			Ckans:   ch.ckans,
+			Updated: ch.modTime.Format("2006-01-02 15:04:05"),
+			URL:     page.Base + "/" + ch.config.archive(),
+		})
+		ch.mu.RUnlock()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := indexTemplate.Execute(w, page)
+	if err != nil {
+		log.Println(err)
+	}
 }
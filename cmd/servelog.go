@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogFormats are formats of `kure serve --access-log`
+var accessLogFormats = []string{"clf", "json", "none"}
+
+// statusWriter remembers status and size of response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// accessEntry is logged request, fields are used by json format
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration_ms"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// clf formats entry in common log format
+func (e accessEntry) clf() string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %d", e.Remote, user,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method+" "+e.URI+" "+e.Proto, e.Status, e.Bytes)
+}
+
+// accessLog wraps handler, so every request is written to out in given
+// format. Writes are serialized, so lines never mix.
+func accessLog(format string, out io.Writer, next http.Handler) http.Handler {
+	if format == "none" {
+		return next
+	}
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		user, _, _ := r.BasicAuth()
+		e := accessEntry{
+			Time:      start,
+			Remote:    remote,
+			User:      user,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    sw.status,
+			Bytes:     sw.bytes,
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+			UserAgent: r.UserAgent(),
+		}
+		line := e.clf()
+		if format == "json" {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			line = string(data)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintln(out, line)
+	})
+}
+
+// serveMetrics writes counters of channels in Prometheus text format
+func (s *repoServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	b.WriteString("# HELP kure_downloads_total Full downloads of channel archive.\n")
+	b.WriteString("# TYPE kure_downloads_total counter\n")
+	for _, ch := range s.channels {
+		ch.mu.RLock()
+		fmt.Fprintf(&b, "kure_downloads_total{channel=%q} %d\n", ch.config.Name, ch.downloads)
+		ch.mu.RUnlock()
+	}
+	b.WriteString("# HELP kure_not_modified_total Requests of channel archive answered with 304 Not Modified.\n")
+	b.WriteString("# TYPE kure_not_modified_total counter\n")
+	for _, ch := range s.channels {
+		ch.mu.RLock()
+		fmt.Fprintf(&b, "kure_not_modified_total{channel=%q} %d\n", ch.config.Name, ch.notModified)
+		ch.mu.RUnlock()
+	}
+	b.WriteString("# HELP kure_packages Ckans in channel archive.\n")
+	b.WriteString("# TYPE kure_packages gauge\n")
+	for _, ch := range s.channels {
+		ch.mu.RLock()
+		fmt.Fprintf(&b, "kure_packages{channel=%q} %d\n", ch.config.Name, ch.ckans)
+		ch.mu.RUnlock()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
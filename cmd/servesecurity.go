@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// publicHost returns host clients use to reach server bound to bind
+func publicHost(bind string) string {
+	if wildcardBind(bind) {
+		return "localhost"
+	}
+	return bind
+}
+
+// wildcardBind reports whether bind listens on all interfaces, so address
+// of server on network is unknown
+func wildcardBind(bind string) bool {
+	switch bind {
+	case "", "0.0.0.0", "::":
+		return true
+	}
+	return false
+}
+
+// selfSignedCert generates certificate for host and localhost, valid for a
+// year. It's kept only in memory, so every start gets new one.
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"kure"}, CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range []string{host, "localhost", "127.0.0.1", "::1"} {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if !contains(template.DNSNames, h) {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certFingerprint returns sha256 of certificate, so users can check it in
+// client
+func certFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	return strings.Join(parts, ":")
+}
+
+// requireAuth wraps handler, so only clients sending credentials from
+// serve_auth get through. Secrets are read from environment once, at start.
+func requireAuth(a *authConfig, next http.Handler) (http.Handler, error) {
+	var expected string
+	switch a.Type {
+	case "bearer":
+		token, err := secretEnv(a.TokenEnv)
+		if err != nil {
+			return nil, err
+		}
+		expected = "Bearer " + token
+	case "basic":
+		user, err := secretEnv(a.UsernameEnv)
+		if err != nil {
+			return nil, err
+		}
+		password, err := secretEnv(a.PasswordEnv)
+		if err != nil {
+			return nil, err
+		}
+		expected = basicAuth(user, password)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+			if a.Type == "basic" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kure"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="kure"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
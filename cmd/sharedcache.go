@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ungerik/go-dry"
+)
+
+// blobStore keeps files under their sha256. It's shared by all workspaces of
+// user, so files are written to temporary file first and renamed into place.
+// Rename is atomic, so other kure process never sees partially written file.
+type blobStore struct {
+	dir string
+	// urls keeps cachedURL of every downloaded archive
+	urls string
+}
+
+// cachedURL remembers archive last downloaded from url and its validators,
+// so archive that did not change is not downloaded again by other workspace
+type cachedURL struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+}
+
+// sharedCacheDir returns root of user level cache shared by workspaces. It's
+// empty when shared cache is disabled.
+func sharedCacheDir() (string, error) {
+	if !conf.SharedCache {
+		return "", nil
+	}
+	if conf.SharedCacheDir != "" {
+		return workspaceAbs(conf.SharedCacheDir), nil
+	}
+	// $XDG_CACHE_HOME or platform equivalent
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "kure"), nil
+}
+
+// sharedBlobs returns shared store or nil when shared cache is disabled
+func sharedBlobs() (*blobStore, error) {
+	dir, err := sharedCacheDir()
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	return &blobStore{dir: filepath.Join(dir, "sha256"), urls: filepath.Join(dir, "url")}, nil
+}
+
+// downloadDir returns directory where netkan.exe caches mod archives
+func downloadDir() (string, error) {
+	dir, err := sharedCacheDir()
+	if err != nil {
+		return "", err
+	}
+	if dir != "" {
+		return filepath.Join(dir, "download"), nil
+	}
+	return workspaceAbs(conf.CacheDir), nil
+}
+
+func (b *blobStore) path(sum string) string {
+	return filepath.Join(b.dir, sum)
+}
+
+// has reports whether store contains file with given hash. Nil store is empty.
+func (b *blobStore) has(sum string) bool {
+	return b != nil && sum != "" && dry.FileExists(b.path(sum))
+}
+
+// put adds copy of file with known hash to store
+func (b *blobStore) put(src, sum string) error {
+	if b == nil || b.has(sum) {
+		return nil
+	}
+	err := os.MkdirAll(b.dir, DirPerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(b.dir, ".put-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	err = dry.FileCopy(src, tmp.Name())
+	if err != nil {
+		return err
+	}
+	if verbose {
+		fmt.Printf("Adding %s to shared cache\n", sum)
+	}
+	return os.Rename(tmp.Name(), b.path(sum))
+}
+
+// get copies file with given hash from store to dst. Copy is verified, so
+// damaged blob is never used.
+func (b *blobStore) get(sum, dst string) error {
+	if verbose {
+		fmt.Printf("Using %s from shared cache\n", sum)
+	}
+	err := dry.FileCopy(b.path(sum), dst)
+	if err != nil {
+		return err
+	}
+	actual, err := hashFile(dst)
+	if err != nil {
+		return err
+	}
+	if actual != sum {
+		os.Remove(dst)
+		return fmt.Errorf("Shared cache entry %s is damaged, remove it", b.path(sum))
+	}
+	return nil
+}
+
+// download saves url to path. When archive last downloaded from url is in
+// store, conditional request is sent and unchanged archive is copied from
+// store instead of downloading it again.
+func (b *blobStore) download(url, path string, auth *repoAuth) error {
+	var cached cachedURL
+	extra := make(http.Header)
+	data, err := ioutil.ReadFile(b.urlPath(url))
+	if err == nil && json.Unmarshal(data, &cached) == nil && b.has(cached.SHA256) {
+		if cached.ETag != "" {
+			extra.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			extra.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := downloadFileIf(url, path, false, auth, extra)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		if verbose {
+			fmt.Printf("%s did not change since last download\n", redactURL(url))
+		}
+		return b.get(cached.SHA256, path)
+	}
+	cached = cachedURL{
+		URL:          redactURL(url),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if cached.ETag == "" && cached.LastModified == "" {
+		// server can't tell whether archive changed
+		return nil
+	}
+	cached.SHA256, err = hashFile(path)
+	if err != nil {
+		return err
+	}
+	err = b.put(path, cached.SHA256)
+	if err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(cached, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(b.urls, DirPerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(b.urls, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.urlPath(url))
+}
+
+// urlPath returns path of cachedURL. Url may contain credentials, so it's
+// hashed.
+func (b *blobStore) urlPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(b.urls, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,404 @@
+package cmd
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ungerik/go-dry"
+)
+
+// snapshot identifies exact content of repo
+type snapshot struct {
+	// sha256 of archive or directory tree
+	SHA256 string `json:"sha256,omitempty"`
+	// git commit
+	Commit string `json:"commit,omitempty"`
+}
+
+func (s snapshot) String() string {
+	if s.Commit != "" {
+		return "commit " + s.Commit
+	}
+	return "sha256 " + s.SHA256
+}
+
+// repoSource is a place repository content can be fetched from
+type repoSource interface {
+	// fetch puts latest repository content into dest directory
+	fetch(dest string) (snapshot, error)
+	// restore puts exactly given snapshot into dest directory. It fails
+	// when snapshot is no longer available.
+	restore(dest string, snap snapshot) error
+	// origin returns url used by last fetch or restore. It's empty if content
+	// came from cache.
+	origin() string
+}
+
+// newRepoSource returns source for given repo. Downloaded archives are kept
+// in snapshots directory and in shared store, if there is one.
+func newRepoSource(repo repoConfig, snapshots string, shared *blobStore) (repoSource, error) {
+	kind, url := repo.Source, repo.URL
+	if kind == "" {
+		kind = guessSourceKind(url)
+	}
+	urls := mirrorURLs(url, repo.Mirrors)
+	for i := range urls {
+		urls[i] = workspaceURL(urls[i])
+	}
+	auth := newRepoAuth(repo.Auth, url)
+	switch kind {
+	case "git":
+		return &gitSource{urls: urls, ref: repo.Ref, auth: auth}, nil
+	case "tar.gz", "tgz":
+		return &archiveSource{urls: urls, auth: auth, snapshots: snapshots, shared: shared, ext: ".tar.gz", unpack: unpackTarGz}, nil
+	case "zip":
+		return &archiveSource{urls: urls, auth: auth, snapshots: snapshots, shared: shared, ext: ".zip", unpack: unZip}, nil
+	case "dir":
+		var paths []string
+		for _, u := range urls {
+			if !isLocalURL(u) {
+				return nil, fmt.Errorf("Directory source must be local path or file:// url, got %s", redactURL(u))
+			}
+			paths = append(paths, localPath(u))
+		}
+		return &dirSource{paths: paths}, nil
+	}
+	return nil, fmt.Errorf("Unknown repo source `%s`", kind)
+}
+
+// guessSourceKind picks source kind by looking at url
+func guessSourceKind(url string) string {
+	if isLocalURL(url) && dry.FileIsDir(localPath(workspaceURL(url))) {
+		return "dir"
+	}
+	if strings.HasSuffix(strings.ToLower(url), ".zip") {
+		return "zip"
+	}
+	return "tar.gz"
+}
+
+// archiveSource is tar.gz or zip archive, remote or local. Every downloaded
+// archive is kept in snapshots directory under its hash. With shared store
+// remote archive is downloaded only if it changed since any workspace
+// downloaded it last time.
+type archiveSource struct {
+	urls      []string
+	used      string
+	auth      *repoAuth
+	snapshots string
+	shared    *blobStore
+	ext       string
+	unpack    func(targetdir, archive string) error
+}
+
+func (s *archiveSource) fetch(dest string) (snapshot, error) {
+	archive, err := s.download()
+	if err != nil {
+		return snapshot{}, err
+	}
+	sum, err := hashFile(archive)
+	if err != nil {
+		return snapshot{}, err
+	}
+	path := s.path(sum)
+	err = os.Rename(archive, path)
+	if err != nil {
+		return snapshot{}, err
+	}
+	err = s.shared.put(path, sum)
+	if err != nil {
+		return snapshot{}, err
+	}
+	return snapshot{SHA256: sum}, s.unpackTo(dest, path)
+}
+
+func (s *archiveSource) restore(dest string, snap snapshot) error {
+	err := os.MkdirAll(s.snapshots, DirPerm)
+	if err != nil {
+		return err
+	}
+	path := s.path(snap.SHA256)
+	if !dry.FileExists(path) && s.shared.has(snap.SHA256) {
+		err = s.shared.get(snap.SHA256, path)
+		if err != nil {
+			return err
+		}
+	}
+	if !dry.FileExists(path) {
+		if verbose {
+			fmt.Printf("Snapshot %s not in cache, downloading it\n", snap.SHA256)
+		}
+		archive, err := s.download()
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(archive)
+		if err != nil {
+			return err
+		}
+		if sum != snap.SHA256 {
+			os.Remove(archive)
+			return fmt.Errorf("Snapshot %s of %s is no longer available", snap.SHA256, redactURL(s.urls[0]))
+		}
+		err = os.Rename(archive, path)
+		if err != nil {
+			return err
+		}
+		err = s.shared.put(path, sum)
+		if err != nil {
+			return err
+		}
+	}
+	return s.unpackTo(dest, path)
+}
+
+// download fetches archive to temporary file in snapshots directory
+func (s *archiveSource) download() (string, error) {
+	err := os.MkdirAll(s.snapshots, DirPerm)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(s.snapshots, "download-")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	s.used, err = tryURLs(s.urls, func(url string) error {
+		if s.shared != nil && !isLocalURL(url) {
+			return s.shared.download(url, tmp.Name(), s.auth)
+		}
+		return fetchFile(url, tmp.Name(), s.auth)
+	})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (s *archiveSource) origin() string {
+	return s.used
+}
+
+func (s *archiveSource) path(sum string) string {
+	return filepath.Join(s.snapshots, sum+s.ext)
+}
+
+func (s *archiveSource) unpackTo(dest, archive string) error {
+	if verbose {
+		fmt.Printf("Unpacking %s to %s\n", archive, dest)
+	}
+	return s.unpack(dest, archive)
+}
+
+// dirSource is plain local directory, for example checkout of netkan repo.
+// First existing path is used.
+type dirSource struct {
+	paths []string
+	path  string
+}
+
+func (s *dirSource) fetch(dest string) (snapshot, error) {
+	sum, err := s.hash()
+	if err != nil {
+		return snapshot{}, err
+	}
+	return snapshot{SHA256: sum}, s.copyTo(dest)
+}
+
+// restore works only if directory did not change since snapshot was taken
+func (s *dirSource) restore(dest string, snap snapshot) error {
+	sum, err := s.hash()
+	if err != nil {
+		return err
+	}
+	if sum != snap.SHA256 {
+		return fmt.Errorf("Content of %s changed since snapshot %s was taken", s.path, snap.SHA256)
+	}
+	return s.copyTo(dest)
+}
+
+func (s *dirSource) origin() string {
+	return s.path
+}
+
+func (s *dirSource) hash() (string, error) {
+	for _, p := range s.paths {
+		if dry.FileIsDir(p) {
+			s.path = p
+			return hashDir(s.path)
+		}
+	}
+	return "", fmt.Errorf("Repo directory %s does not exist", strings.Join(s.paths, ", "))
+}
+
+func (s *dirSource) copyTo(dest string) error {
+	if verbose {
+		fmt.Printf("Copying %s to %s\n", s.path, dest)
+	}
+	err := os.RemoveAll(dest)
+	if err != nil {
+		return err
+	}
+	return dry.FileCopyDir(s.path, dest)
+}
+
+// isLocalURL reports whether url is file:// url or plain path
+func isLocalURL(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	// single letter scheme is windows drive
+	return u.Scheme == "file" || len(u.Scheme) <= 1
+}
+
+// workspaceURL resolves relative path against workspace root. Urls, including
+// file:// ones, are returned unchanged.
+func workspaceURL(rawurl string) string {
+	if isLocalURL(rawurl) && localPath(rawurl) == rawurl {
+		return workspaceAbs(rawurl)
+	}
+	return rawurl
+}
+
+// localPath converts file:// url to path. Other urls are returned unchanged.
+func localPath(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "file" {
+		return rawurl
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// fetchFile copies local file or downloads remote one to path
+func fetchFile(url, path string, auth *repoAuth) error {
+	if !isLocalURL(url) {
+		return downloadFile(url, path, false, auth)
+	}
+	src := localPath(url)
+	if verbose {
+		fmt.Printf("Copying file\nfrom: %s\nto: %s\n", src, path)
+	}
+	err := dry.FileCopy(src, path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+func unpackTarGz(targetdir, archive string) error {
+	tgz, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer tgz.Close()
+	return unTarGz(targetdir, tgz)
+}
+
+func unZip(targetdir, archive string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		target := filepath.Join(targetdir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(target, filepath.Clean(targetdir)+string(os.PathSeparator)) {
+			return errors.New("Illegal file path in zip archive: " + f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			err = os.MkdirAll(target, DirPerm)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(target), DirPerm)
+		if err != nil {
+			return err
+		}
+		err = unZipFile(f, target)
+		if err != nil {
+			return err
+		}
+		os.Chtimes(target, f.Modified, f.Modified)
+	}
+	return nil
+}
+
+func unZipFile(f *zip.File, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// hashFile returns hex encoded sha256 of file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashDir returns hex encoded sha256 of all file names and contents in dir.
+// Git metadata is ignored.
+func hashDir(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() && f.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if f.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, path := range files {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return "", err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", filepath.ToSlash(rel), sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
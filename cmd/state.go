@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// workspaceState is what kure remembers about workspace between runs.
+// It's kept in cache/state.json.
+type workspaceState struct {
+	Repos map[string]repoState `json:"repos,omitempty"`
+	// active netkan.exe version, default when empty
+	Netkan string `json:"netkan,omitempty"`
+	// last build of every netkan file, by path relative to workspace
+	Builds map[string]buildResult `json:"builds,omitempty"`
+}
+
+// repoState describes last successful update of repo
+type repoState struct {
+	Type   string `json:"type"`
+	Source string `json:"source,omitempty"`
+	URL    string `json:"url"`
+	Ref    string `json:"ref,omitempty"`
+	snapshot
+	Updated time.Time `json:"updated"`
+}
+
+// buildResult describes last build of netkan file
+type buildResult struct {
+	Netkan       string    `json:"netkan"`
+	NetkanSHA256 string    `json:"netkan_sha256"`
+	Built        time.Time `json:"built"`
+	Failed       bool      `json:"failed,omitempty"`
+}
+
+func statePath() string {
+	return workspacePath("cache", "state.json")
+}
+
+// loadState reads workspace state. Missing state file is not an error.
+func loadState() (*workspaceState, error) {
+	state := &workspaceState{}
+	data, err := ioutil.ReadFile(statePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *workspaceState) save() error {
+	path := statePath()
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (s *workspaceState) setRepo(repo repoConfig, snap snapshot) {
+	if s.Repos == nil {
+		s.Repos = make(map[string]repoState)
+	}
+	s.Repos[repo.Name] = repoState{
+		Type:     repo.Type,
+		Source:   repo.Source,
+		URL:      repo.URL,
+		Ref:      repo.Ref,
+		snapshot: snap,
+		Updated:  time.Now(),
+	}
+}
+
+func (s *workspaceState) setBuild(netkanFile string, result buildResult) {
+	if s.Builds == nil {
+		s.Builds = make(map[string]buildResult)
+	}
+	// older kure recorded builds by file name only
+	delete(s.Builds, path.Base(netkanFile))
+	s.Builds[netkanFile] = result
+}
@@ -6,20 +6,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/bitly/go-simplejson"
+	"github.com/ryanuber/columnize"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"github.com/ungerik/go-dry"
 )
 
 var (
 	netkan  = false
 	clean   = false
 	noClean = false
+	locked  = false
 )
 
 // updateCmd represents the update command
@@ -31,6 +34,9 @@ var updateCmd = &cobra.Command{
 		if c := checkWorkspace(); c != nil {
 			return c
 		}
+		if c := lockWorkspace(exclusiveLock); c != nil {
+			return c
+		}
 		if netkan {
 			return downloadNetkan()
 		}
@@ -42,7 +48,12 @@ var updateCmd = &cobra.Command{
 			if err != nil {
 				return errors.New("Error while cleaning repo cache: " + err.Error())
 			}
-			return err
+			state, err := loadState()
+			if err != nil {
+				return err
+			}
+			state.Repos = nil
+			return state.save()
 		}
 
 		return downloadRepos()
@@ -54,158 +65,268 @@ func init() {
 	RootCmd.AddCommand(updateCmd)
 	updateCmd.Flags().BoolVarP(&netkan, "netkan", "n", false, "Update netkan tool")
 	updateCmd.Flags().BoolVarP(&clean, "clean", "c", false, "Remove cached netkan packages.")
-	updateCmd.Flags().BoolVarP(&noClean, "no-clean", "C", false, "Disable automatic cleaning befroe update")
+	updateCmd.Flags().BoolVar(&noClean, "no-clean", false, "Disable automatic cleaning befroe update")
+	updateCmd.Flags().BoolVarP(&locked, "locked", "l", false, "Restore repos exactly as recorded in kure.lock")
+	// -C used to be shorthand of --no-clean, now it selects workspace
+	updateCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		if strings.Contains(err.Error(), "'C' in -C") {
+			return fmt.Errorf("%s. -C of update is now --workspace, use --no-clean to skip cleaning", err)
+		}
+		return err
+	})
 }
 
+// downloadNetkan replaces cache/bin/netkan.exe with fresh download
 func downloadNetkan() error {
-	pwd, err := os.Getwd()
-	if err != nil {
-		return errors.New("Cannot get working directory")
-	}
-	path := filepath.Join(pwd, "cache", "bin", "netkan.exe")
-	url := viper.GetString("netkan_exe")
-	err = downloadFile(url, path, true)
+	path := workspacePath("cache", "bin", "netkan.exe")
+	pin := conf.NetkanExeSHA256
+	_, err := installNetkanFile(conf.NetkanExe, pin, path)
 	if err != nil {
 		return err
 	}
+	if pin == "" {
+		fmt.Println("Set netkan_exe_sha256 in kure.json to verify future downloads.")
+	}
 	return nil
 }
 
 func downloadRepos() error {
-	pwd, err := os.Getwd()
+	repos := conf.Repos
+
+	state, err := loadState()
 	if err != nil {
-		return errors.New("Cannot get working directory")
+		return err
+	}
+	// whole lock is checked before anything in cache changes
+	var lockedRepos []lockedRepo
+	if locked {
+		lock, err := loadLockFile()
+		if err != nil {
+			return err
+		}
+		for _, repo := range repos {
+			l, err := lock.find(repo)
+			if err != nil {
+				return err
+			}
+			lockedRepos = append(lockedRepos, l)
+		}
 	}
-	file, err := os.Open("kure.json")
+	shared, err := sharedBlobs()
 	if err != nil {
 		return err
 	}
-	json, err := simplejson.NewFromReader(file)
+	// repos are fetched into staging directory and moved into cache/repo
+	// only when all of them succeed. Existing git clones are fetched in
+	// place, but checked out only after that too.
+	staging := workspacePath("cache", "staging")
+	err = os.RemoveAll(staging)
 	if err != nil {
 		return err
 	}
-	// names of already downloaded repos
-	var done []string
-
-	if !noClean {
-		if verbose {
-			Warn("Cleaning up old cached\n")
-		}
-		err = cleanRepo()
+	defer os.RemoveAll(staging)
+	newLock := &lockFile{}
+	report := []string{"repo | snapshot | from"}
+	clones := make(map[string]*gitSource)
+	checkouts := make(map[string]string)
+	for i, repo := range repos {
+		source, err := newRepoSource(repo, workspacePath("cache", "snapshot"), shared)
 		if err != nil {
-			Warn("Could not clean repo cache.\n")
-			fmt.Println("Update will proceed but you should clean repo cache manually and update again.")
-		}
-	}
-
-	for _, v := range json.Get("repos").MustArray() {
-		vv, found := v.(map[string]interface{})
-		if !found {
-			return errors.New("Not found repos array in config file")
-		}
-
-		repoName, found := vv["name"].(string)
-		if !found {
-			return errors.New("Not found type of repo")
-		}
-
-		repoType, found := vv["type"].(string)
-		if !found {
-			return errors.New("Not found type of repo")
+			return err
 		}
-
-		url, found := vv["url"].(string)
-		if !found {
-			return errors.New("Not found url of repo")
+		dest := workspacePath("cache", "repo", repo.Name)
+		clone, isGit := source.(*gitSource)
+		if isGit && dry.FileIsDir(filepath.Join(dest, ".git")) {
+			clones[repo.Name] = clone
+		} else {
+			dest = filepath.Join(staging, repo.Name)
 		}
-
-		//check if not downloaded (enforce uniqe repo names)
-		if !contains(done, repoName) {
+		var snap snapshot
+		fetched := time.Now()
+		if locked {
+			l := lockedRepos[i]
 			if verbose {
-				fmt.Printf("Downloading %s (%s) repo\nUrl: %s\n", repoName, repoType, url)
+				fmt.Printf("Restoring %s (%s) repo\nUrl: %s\n", repo.Name, repo.Type, redactURL(repo.URL))
+			}
+			snap, fetched = l.snapshot, l.Fetched
+			if clones[repo.Name] != nil {
+				err = clone.restoreObjects(dest, snap)
+			} else {
+				err = source.restore(dest, snap)
 			}
-			// download tar.gz
-			path := filepath.Join(pwd, "cache", "repo", repoType+"_"+repoName+".tar.gz")
-			err = downloadFile(url, path, false)
 			if err != nil {
 				return err
 			}
-
-			//unpack tar.gz
-			final := filepath.Join(pwd, "cache", "repo", repoName)
+		} else {
 			if verbose {
-				fmt.Printf("Unpackging %s to %s\n", path, final)
+				fmt.Printf("Downloading %s (%s) repo\nUrl: %s\n", repo.Name, repo.Type, redactURL(repo.URL))
+			}
+			if clones[repo.Name] != nil {
+				snap, err = clone.fetchObjects(dest)
+			} else {
+				snap, err = source.fetch(dest)
 			}
-			var tgz *os.File
-			tgz, err = os.Open(path)
-			defer tgz.Close()
-			err = unTarGz(final, tgz)
 			if err != nil {
 				return err
 			}
+		}
+		if clones[repo.Name] != nil {
+			checkouts[repo.Name] = snap.Commit
+		}
+		from := source.origin()
+		if from == "" {
+			from = "cache"
+		} else if from != workspaceURL(repo.URL) {
+			Warn("%s fetched from mirror %s\n", repo.Name, redactURL(from))
+		}
+		report = append(report, fmt.Sprintf("%s | %s | %s", repo.Name, snap, redactURL(from)))
+		state.setRepo(repo, snap)
+		newLock.add(repo, snap, fetched)
+	}
 
-			done = append(done, repoName)
-		} else {
-			fmt.Printf("Warning: repo name `%s` is not uniqe. Ignoring `%s` url.\n", repoName, url)
+	if !noClean {
+		if verbose {
+			Warn("Cleaning up old cached\n")
+		}
+		// git clones are kept and fetched instead of cloned again
+		var keep []string
+		for name := range clones {
+			keep = append(keep, name)
+		}
+		err := cleanRepo(keep...)
+		if err != nil {
+			Warn("Could not clean repo cache.\n")
+			fmt.Println("Update will proceed but you should clean repo cache manually and update again.")
+		}
+	}
+	for _, repo := range repos {
+		dest := workspacePath("cache", "repo", repo.Name)
+		if clones[repo.Name] != nil {
+			err = clones[repo.Name].checkout(dest, checkouts[repo.Name])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.RemoveAll(dest)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(dest), DirPerm)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(staging, repo.Name), dest)
+		if err != nil {
+			return err
+		}
+	}
+	err = state.save()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		err = newLock.save()
+		if err != nil {
+			return err
 		}
 	}
+	fmt.Println(columnize.SimpleFormat(report))
 	Done("Update finished\n")
 	return nil
 }
 
-func downloadFile(url, path string, exe bool) error {
-	var out *os.File
-	var err error
-	if _, err = os.Stat(path); os.IsNotExist(err) {
-		if verbose {
+// downloadFile saves url to path. Auth may be nil.
+func downloadFile(url, path string, exe bool, auth *repoAuth) error {
+	_, err := downloadFileIf(url, path, exe, auth, nil)
+	return err
+}
+
+// downloadFileIf downloads file sending additional request headers, like
+// conditional ones. Returned response has closed body. Its status is 304 Not
+// Modified when server says file did not change. File is downloaded next to
+// path and replaces it only when download is complete, so failed download
+// leaves path as it was.
+func downloadFileIf(url, path string, exe bool, auth *repoAuth, extra http.Header) (*http.Response, error) {
+	if verbose {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
 			fmt.Printf("Creating file %s\n", path)
-		}
-		out, err = os.Create(path)
-	} else {
-		if verbose {
+		} else {
 			fmt.Printf("Overwrite %s\n", filepath.Base(path))
 		}
-		out, err = os.OpenFile(path, os.O_WRONLY, 0700)
 	}
-	defer out.Close()
+	if verbose {
+		fmt.Printf("Downloading file\nfrom: %s\nto: %s\n", redactURL(url), path)
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if verbose {
-		fmt.Printf("Downloading file\nfrom: %s\nto: %s\n", url, path)
+	for k, v := range extra {
+		req.Header[k] = v
+	}
+	header, err := auth.header(url)
+	if err != nil {
+		return nil, err
+	}
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
-	resp, err := http.Get(url)
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && len(extra) > 0 {
+		return resp, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not download %s: %s", redactURL(url), resp.Status)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(path), ".download-")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer os.Remove(out.Name())
 	_, err = io.Copy(out, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if exe {
-		err = os.Chmod(path, 0700)
+		err = os.Chmod(out.Name(), 0700)
 	} else {
-		err = os.Chmod(path, 0600)
+		err = os.Chmod(out.Name(), 0600)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return resp, os.Rename(out.Name(), path)
 }
 
-func cleanRepo() error {
-	pwd, err := os.Getwd()
+// cleanRepo removes everything from cache/repo except given entries
+func cleanRepo(keep ...string) error {
+	repoPath := workspacePath("cache", "repo")
+	err := os.MkdirAll(repoPath, DirPerm)
 	if err != nil {
 		return err
 	}
-	repoPath := filepath.Join(pwd, "cache", "repo")
-	err = os.RemoveAll(repoPath)
+	entries, err := ioutil.ReadDir(repoPath)
 	if err != nil {
 		return err
 	}
-	err = os.MkdirAll(repoPath, DirPerm)
-	return err
+	for _, e := range entries {
+		if contains(keep, e.Name()) {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(repoPath, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func contains(s []string, e string) bool {
@@ -233,7 +354,10 @@ func unTarGz(targetdir string, reader io.ReadCloser) error {
 			return err
 		}
 
-		target := path.Join(targetdir, header.Name)
+		target := filepath.Join(targetdir, filepath.FromSlash(header.Name))
+		if target != filepath.Clean(targetdir) && !strings.HasPrefix(target, filepath.Clean(targetdir)+string(os.PathSeparator)) {
+			return errors.New("Illegal file path in tar archive: " + header.Name)
+		}
 		switch header.Typeflag {
 		case tar.TypeDir:
 			err = os.MkdirAll(target, os.FileMode(header.Mode))
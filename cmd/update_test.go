@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipFile(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkInside fails if anything but target directory was created in root
+func checkInside(t *testing.T, root string) {
+	t.Helper()
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "target" && e.Name() != "archive.zip" {
+			t.Errorf("%s was written outside of target directory", e.Name())
+		}
+	}
+}
+
+func TestUnpackEscapingPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		wantErr bool
+	}{
+		{"parent", "../escaped.ckan", true},
+		{"nested parent", "meta/../../escaped.ckan", true},
+		{"absolute", "/escaped.ckan", false},
+		{"inside", "meta/../inside.ckan", false},
+	}
+	for _, tt := range tests {
+		t.Run("tar/"+tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			target := filepath.Join(root, "target")
+			if err := os.Mkdir(target, DirPerm); err != nil {
+				t.Fatal(err)
+			}
+			data := tarGz(t, map[string]string{tt.entry: "{}"})
+			err := unTarGz(target, ioutil.NopCloser(bytes.NewReader(data)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unTarGz error = %v, want error %v", err, tt.wantErr)
+			}
+			checkInside(t, root)
+		})
+		t.Run("zip/"+tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			target := filepath.Join(root, "target")
+			if err := os.Mkdir(target, DirPerm); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(root, "archive.zip")
+			zipFile(t, archive, map[string]string{tt.entry: "{}"})
+			err := unZip(target, archive)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unZip error = %v, want error %v", err, tt.wantErr)
+			}
+			checkInside(t, root)
+		})
+	}
+}
+
+func TestDownloadFileKeepsTargetOnFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			w.Write([]byte("new"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "netkan.exe")
+	if err := ioutil.WriteFile(path, []byte("old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	err := downloadFile(srv.URL+"/missing", path, true, nil)
+	if err == nil {
+		t.Fatal("download of missing file succeeded")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "old" {
+		t.Errorf("failed download changed file to %q", data)
+	}
+
+	err = downloadFile(srv.URL+"/ok", path, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "new" {
+		t.Errorf("downloaded file is %q, want \"new\"", data)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left in %s: %d entries", dir, len(entries))
+	}
+}